@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// The admin interface is a plain-text line protocol on admin_addr. It has no authentication, so
+// admin_addr must be a loopback address.
+// Commands:
+//   LOCKOUTS          list active authentication lockouts
+//   UNLOCK <key|all>  clear a lockout (key as printed by LOCKOUTS, e.g. ip:10.0.0.1 or user:app@domain.com)
+// Every reply ends with a line "OK" or "ERR <message>".
+
+// checkAdminAddr refuses admin addresses reachable from other hosts
+func checkAdminAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+	if !isLoopbackHost(host) {
+		return fmt.Errorf("admin_addr %s must be a loopback address, the admin interface has no authentication", addr)
+	}
+	return nil
+}
+
+// isLoopbackHost reports whether host is localhost or a loopback IP
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listenAdmin binds the admin interface on a loopback address
+func listenAdmin(addr string) (net.Listener, error) {
+	if err := checkAdminAddr(addr); err != nil {
+		return nil, err
+	}
+	return net.Listen("tcp", addr)
+}
+
+func adminServe(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logger.Debug("Admin listener stopped", "error", err)
+			return
+		}
+		if ip := net.ParseIP(remoteIP(conn.RemoteAddr())); ip == nil || !ip.IsLoopback() {
+			logger.Warn("Admin connection rejected", "remote", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		go handleAdminConnection(conn)
+	}
+}
+
+func handleAdminConnection(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Minute))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		logger.Info("Admin command", "event", "admin_command", "remote", conn.RemoteAddr().String(), "command", strings.TrimSpace(line))
+		switch strings.ToUpper(fields[0]) {
+		case "LOCKOUTS":
+			for _, l := range authGuard.list() {
+				fmt.Fprintf(writer, "%s failures=%d locked_until=%s\n", l.Key, l.Failures, l.LockedUntil.Format(time.RFC3339))
+			}
+			fmt.Fprintf(writer, "OK\n")
+		case "UNLOCK":
+			if len(fields) != 2 {
+				fmt.Fprintf(writer, "ERR usage: UNLOCK <key|all>\n")
+				break
+			}
+			fmt.Fprintf(writer, "cleared=%d\nOK\n", authGuard.clear(fields[1]))
+		case "QUIT":
+			fmt.Fprintf(writer, "OK\n")
+			writer.Flush()
+			return
+		default:
+			fmt.Fprintf(writer, "ERR unknown command\n")
+		}
+		writer.Flush()
+	}
+}
+
+// adminCommand sends a single command to the running service and returns its reply lines
+func adminCommand(addr, command string) ([]string, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("admin_addr is not configured")
+	}
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := fmt.Fprintf(conn, "%s\n", command); err != nil {
+		return nil, err
+	}
+	var lines []string
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return lines, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "OK" {
+			return lines, nil
+		}
+		if strings.HasPrefix(line, "ERR") {
+			return lines, fmt.Errorf("%s", strings.TrimSpace(strings.TrimPrefix(line, "ERR")))
+		}
+		lines = append(lines, line)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Classes of token endpoint failures, each mapped to its own SMTP reply
+const (
+	authErrCredentials = "credentials"
+	authErrMFA         = "mfa"
+	authErrTemporary   = "temporary"
+)
+
+// tokenError is returned by getOAuth2TokenWithExpiry when the token endpoint rejects the request
+type tokenError struct {
+	StatusCode  int
+	ErrorCode   string // OAuth2 "error" (e.g. invalid_grant)
+	AADSTS      int    // first entry of "error_codes" (e.g. 50126)
+	Description string
+}
+
+func (e *tokenError) Error() string {
+	if e.AADSTS != 0 {
+		return fmt.Sprintf("token endpoint error %s (AADSTS%d, HTTP %d): %s", e.ErrorCode, e.AADSTS, e.StatusCode, e.Description)
+	}
+	return fmt.Sprintf("token endpoint error %s (HTTP %d): %s", e.ErrorCode, e.StatusCode, e.Description)
+}
+
+// AADSTS codes caused by the user's credentials or account state
+var aadstsCredentialCodes = map[int]bool{
+	50034: true, // user account does not exist
+	50053: true, // account locked / sign-in blocked by smart lockout
+	50055: true, // password expired
+	50056: true, // invalid or null password
+	50057: true, // user account disabled
+	50126: true, // invalid username or password
+	50144: true, // Active Directory password expired
+	50173: true, // grant expired because the password changed
+}
+
+// AADSTS codes caused by MFA or Conditional Access, which ROPC can't satisfy
+var aadstsMFACodes = map[int]bool{
+	50072:  true, // MFA enrollment required
+	50074:  true, // strong authentication required
+	50076:  true, // MFA required
+	50079:  true, // MFA registration required
+	50158:  true, // external security challenge not satisfied
+	53000:  true, // device not compliant
+	53001:  true, // device not domain joined
+	53002:  true, // application not approved
+	53003:  true, // blocked by Conditional Access
+	53004:  true, // proof-up required
+	530032: true, // blocked by security policy
+}
+
+// classifyAuthError maps a token retrieval error to a failure class
+func classifyAuthError(err error) string {
+	var te *tokenError
+	if !errors.As(err, &te) {
+		return authErrTemporary // network errors, unreadable responses
+	}
+	switch {
+	case aadstsMFACodes[te.AADSTS]:
+		return authErrMFA
+	case aadstsCredentialCodes[te.AADSTS]:
+		return authErrCredentials
+	case te.StatusCode == 429 || te.StatusCode >= 500:
+		return authErrTemporary
+	case te.AADSTS == 0 && strings.EqualFold(te.ErrorCode, "invalid_grant"):
+		return authErrCredentials
+	}
+	return authErrTemporary
+}
+
+// authFailureReply returns the SMTP reply for an authentication failure class
+func authFailureReply(class string) string {
+	switch class {
+	case authErrCredentials:
+		return "535 5.7.8 Authentication credentials invalid"
+	case authErrMFA:
+		return "534 5.7.9 Authentication mechanism is too weak (MFA or Conditional Access required)"
+	}
+	return "454 4.7.0 Temporary authentication failure"
+}
+
+// isRefreshTokenRevoked reports whether a refresh token grant failed because the refresh token is
+// expired or revoked (password change, session revocation), so only the password can get a new one
+func isRefreshTokenRevoked(err error) bool {
+	var te *tokenError
+	return errors.As(err, &te) && te.ErrorCode == "invalid_grant"
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestClassifyAuthError(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		class string
+		reply string
+	}{
+		{"bad password", &tokenError{StatusCode: 400, ErrorCode: "invalid_grant", AADSTS: 50126}, authErrCredentials, "535 5.7.8"},
+		{"mfa", &tokenError{StatusCode: 400, ErrorCode: "invalid_grant", AADSTS: 50076}, authErrMFA, "534 5.7.9"},
+		{"conditional access", fmt.Errorf("wrapped: %w", &tokenError{StatusCode: 400, ErrorCode: "invalid_grant", AADSTS: 53003}), authErrMFA, "534 5.7.9"},
+		{"server error", &tokenError{StatusCode: 503, ErrorCode: "temporarily_unavailable"}, authErrTemporary, "454 4.7.0"},
+		{"throttled", &tokenError{StatusCode: 429}, authErrTemporary, "454 4.7.0"},
+		{"network", errors.New("dial tcp: i/o timeout"), authErrTemporary, "454 4.7.0"},
+	}
+	for _, tt := range tests {
+		class := classifyAuthError(tt.err)
+		if class != tt.class {
+			t.Errorf("%s: expected class '%s', got '%s'", tt.name, tt.class, class)
+		}
+		if reply := authFailureReply(class); !strings.HasPrefix(reply, tt.reply) {
+			t.Errorf("%s: expected reply '%s', got '%s'", tt.name, tt.reply, reply)
+		}
+	}
+}
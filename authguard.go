@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tAuthGuardConfig holds the brute-force protection settings.
+// Zero values fall back to the defaults below, a negative max disables that counter.
+type tAuthGuardConfig struct {
+	MaxIPFailures   int           `yaml:"max_ip_failures"`
+	MaxUserFailures int           `yaml:"max_user_failures"`
+	FailureWindow   time.Duration `yaml:"failure_window"`
+	LockoutDuration time.Duration `yaml:"lockout_duration"`
+	DelayStep       time.Duration `yaml:"delay_step"`
+	MaxDelay        time.Duration `yaml:"max_delay"`
+}
+
+const (
+	defaultMaxIPFailures   = 10
+	defaultMaxUserFailures = 5
+	defaultFailureWindow   = 15 * time.Minute
+	defaultLockoutDuration = 15 * time.Minute
+	defaultDelayStep       = time.Second
+	defaultMaxDelay        = 10 * time.Second
+)
+
+type authFailure struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// lockoutInfo describes an active lockout (used by the admin interface)
+type lockoutInfo struct {
+	Key         string
+	Failures    int
+	LockedUntil time.Time
+}
+
+// tAuthGuard tracks failed authentications per IP and per username (thread-safe)
+type tAuthGuard struct {
+	mu      sync.Mutex
+	entries map[string]*authFailure
+	now     func() time.Time
+}
+
+var authGuard = newAuthGuard()
+
+func newAuthGuard() *tAuthGuard {
+	return &tAuthGuard{entries: make(map[string]*authFailure), now: time.Now}
+}
+
+func authGuardIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+func authGuardUserKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+// remoteIP returns the IP part of a connection's remote address
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// locked reports whether the IP or the username is currently locked out.
+// An empty username checks the IP only.
+func (g *tAuthGuard) locked(ip, username string) (string, time.Time, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	keys := []string{authGuardIPKey(ip)}
+	if username != "" {
+		keys = append(keys, authGuardUserKey(username))
+	}
+	for _, key := range keys {
+		if e, ok := g.entries[key]; ok && now.Before(e.lockedUntil) {
+			return key, e.lockedUntil, true
+		}
+	}
+	return "", time.Time{}, false
+}
+
+// fail records a failed authentication and returns the delay to apply before replying
+func (g *tAuthGuard) fail(c tAuthGuardConfig, ip, username string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	maxIP := intOrDefault(c.MaxIPFailures, defaultMaxIPFailures)
+	maxUser := intOrDefault(c.MaxUserFailures, defaultMaxUserFailures)
+	window := durationOrDefault(c.FailureWindow, defaultFailureWindow)
+	lockout := durationOrDefault(c.LockoutDuration, defaultLockoutDuration)
+
+	highest := 0
+	record := func(key string, max int) {
+		if max < 0 {
+			return
+		}
+		e, ok := g.entries[key]
+		if !ok || (now.Sub(e.first) > window && now.After(e.lockedUntil)) {
+			e = &authFailure{first: now}
+			g.entries[key] = e
+		}
+		e.count++
+		if e.count > highest {
+			highest = e.count
+		}
+		if e.count >= max && now.After(e.lockedUntil) {
+			e.lockedUntil = now.Add(lockout)
+			logger.Warn("Authentication lockout", "event", "auth_lockout", "key", key, "failures", e.count, "locked_until", e.lockedUntil)
+		}
+	}
+	record(authGuardIPKey(ip), maxIP)
+	if username != "" {
+		record(authGuardUserKey(username), maxUser)
+	}
+	logger.Warn("Authentication failure", "event", "auth_failure", "ip", ip, "username", username, "failures", highest)
+	g.prune(now, window)
+
+	delay := time.Duration(highest) * durationOrDefault(c.DelayStep, defaultDelayStep)
+	if maxDelay := durationOrDefault(c.MaxDelay, defaultMaxDelay); delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// success clears the username's failure counter after a successful authentication. The IP counter
+// only expires: one valid account must not let its IP reset the count and keep guessing other users.
+func (g *tAuthGuard) success(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.entries, authGuardUserKey(username))
+}
+
+// list returns the active lockouts sorted by key
+func (g *tAuthGuard) list() []lockoutInfo {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	var out []lockoutInfo
+	for key, e := range g.entries {
+		if now.Before(e.lockedUntil) {
+			out = append(out, lockoutInfo{Key: key, Failures: e.count, LockedUntil: e.lockedUntil})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// clear removes the counters for key ("ip:x", "user:x") or for everything if key is "all".
+// Returns the number of removed entries.
+func (g *tAuthGuard) clear(key string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if strings.EqualFold(key, "all") {
+		n := len(g.entries)
+		g.entries = make(map[string]*authFailure)
+		logger.Info("Authentication lockouts cleared", "event", "auth_lockout_cleared", "key", "all", "count", n)
+		return n
+	}
+	if strings.HasPrefix(key, "user:") {
+		key = authGuardUserKey(key[5:])
+	}
+	if _, ok := g.entries[key]; !ok {
+		return 0
+	}
+	delete(g.entries, key)
+	logger.Info("Authentication lockout cleared", "event", "auth_lockout_cleared", "key", key)
+	return 1
+}
+
+// prune drops stale counters so the map doesn't grow without bound
+func (g *tAuthGuard) prune(now time.Time, window time.Duration) {
+	for key, e := range g.entries {
+		if now.Sub(e.first) > window && now.After(e.lockedUntil) {
+			delete(g.entries, key)
+		}
+	}
+}
+
+func intOrDefault(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+func durationOrDefault(v, def time.Duration) time.Duration {
+	if v == 0 {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthGuard_UserLockout(t *testing.T) {
+	g := newAuthGuard()
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	g.now = func() time.Time { return now }
+	c := tAuthGuardConfig{MaxUserFailures: 3, MaxIPFailures: 10, LockoutDuration: time.Minute}
+	for i := 0; i < 2; i++ {
+		g.fail(c, "10.0.0.1", "app@domain.com")
+	}
+	if _, _, locked := g.locked("10.0.0.1", "app@domain.com"); locked {
+		t.Fatalf("expected no lockout after 2 failures")
+	}
+	g.fail(c, "10.0.0.2", "App@Domain.com")
+	key, _, locked := g.locked("10.0.0.3", "app@domain.com")
+	if !locked || key != "user:app@domain.com" {
+		t.Fatalf("expected user lockout, got locked=%v key='%s'", locked, key)
+	}
+	if _, _, locked := g.locked("10.0.0.3", "other@domain.com"); locked {
+		t.Errorf("expected other user not to be locked")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, _, locked := g.locked("10.0.0.3", "app@domain.com"); locked {
+		t.Errorf("expected lockout to expire")
+	}
+}
+
+func TestAuthGuard_IPLockoutAndClear(t *testing.T) {
+	g := newAuthGuard()
+	c := tAuthGuardConfig{MaxIPFailures: 2, MaxUserFailures: -1}
+	g.fail(c, "10.0.0.1", "a@domain.com")
+	g.fail(c, "10.0.0.1", "b@domain.com")
+	if _, _, locked := g.locked("10.0.0.1", ""); !locked {
+		t.Fatalf("expected IP lockout")
+	}
+	if l := g.list(); len(l) != 1 || l[0].Key != "ip:10.0.0.1" {
+		t.Fatalf("expected one IP lockout, got %v", l)
+	}
+	if n := g.clear("ip:10.0.0.1"); n != 1 {
+		t.Errorf("expected 1 cleared entry, got %d", n)
+	}
+	if _, _, locked := g.locked("10.0.0.1", ""); locked {
+		t.Errorf("expected IP lockout to be cleared")
+	}
+}
+
+func TestAuthGuard_ProgressiveDelay(t *testing.T) {
+	g := newAuthGuard()
+	c := tAuthGuardConfig{DelayStep: time.Second, MaxDelay: 3 * time.Second, MaxIPFailures: 100, MaxUserFailures: 100}
+	expected := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}
+	for i, want := range expected {
+		if got := g.fail(c, "10.0.0.1", "app@domain.com"); got != want {
+			t.Errorf("failure %d: expected delay %v, got %v", i+1, want, got)
+		}
+	}
+	g.success("app@domain.com")
+	if got := g.fail(c, "10.0.0.2", "app@domain.com"); got != time.Second {
+		t.Errorf("expected user delay to reset after success, got %v", got)
+	}
+	if got := g.fail(c, "10.0.0.1", "other@domain.com"); got != 3*time.Second {
+		t.Errorf("expected the IP counter to survive a success, got delay %v", got)
+	}
+}
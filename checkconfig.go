@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configProblem is one finding of -check-config; Line is 0 when the value isn't in the file (default or environment)
+type configProblem struct {
+	Line int
+	Path string
+	Msg  string
+}
+
+func (p configProblem) String() string {
+	s := p.Msg
+	if p.Path != "" {
+		s = p.Path + ": " + s
+	}
+	if p.Line > 0 {
+		s = fmt.Sprintf("line %d: %s", p.Line, s)
+	}
+	return s
+}
+
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlProblem converts a yaml.v3 error message ("line 3: field foo not found ...") into a problem
+func yamlProblem(msg string) configProblem {
+	if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return configProblem{Line: line, Msg: m[2]}
+	}
+	return configProblem{Msg: strings.TrimPrefix(msg, "yaml: ")}
+}
+
+// checkConfigFile strictly decodes the config file, applies the environment overrides and validates the result.
+// The returned config is nil if the file couldn't be read or parsed at all.
+func checkConfigFile(path string) (*tConfig, []configProblem) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && path == defaultConfigFile() {
+		data, err = nil, nil
+	}
+	if err != nil {
+		return nil, []configProblem{{Msg: err.Error()}}
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, []configProblem{yamlProblem(err.Error())}
+	}
+	var problems []configProblem
+	c := &tConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		var te *yaml.TypeError
+		if !errors.As(err, &te) {
+			return nil, []configProblem{yamlProblem(err.Error())}
+		}
+		for _, e := range te.Errors {
+			problems = append(problems, yamlProblem(e))
+		}
+	}
+	if err := applyEnvOverrides(c); err != nil {
+		problems = append(problems, configProblem{Msg: err.Error()})
+	}
+	if err := resolveSecretRefs(c); err != nil {
+		problems = append(problems, configProblem{Msg: err.Error()})
+	}
+	if err := decryptConfigStrings(c); err != nil {
+		problems = append(problems, configProblem{Msg: "failed to decrypt config: " + err.Error()})
+	}
+	return c, append(problems, validateConfig(c, &root)...)
+}
+
+// yamlLine returns the line of the value at a dotted path like "listeners.0.tls_cert", or the
+// line of its closest parent present in the file
+func yamlLine(root *yaml.Node, path string) int {
+	n := root
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	line := 0
+	for _, key := range strings.Split(path, ".") {
+		var next *yaml.Node
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == key {
+					next = n.Content[i+1]
+					line = n.Content[i].Line
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(key); err == nil && i < len(n.Content) {
+				next = n.Content[i]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			break
+		}
+		n = next
+	}
+	return line
+}
+
+var tenantIDPattern = regexp.MustCompile(`^([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)+)$`)
+
+// validateConfig reports semantic problems of the effective config; root is the parsed file used for line numbers
+func validateConfig(c *tConfig, root *yaml.Node) []configProblem {
+	var problems []configProblem
+	add := func(path, format string, args ...any) {
+		problems = append(problems, configProblem{Line: yamlLine(root, path), Path: path, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	switch strings.ToLower(c.LogLevel) {
+	case "", "debug", "info", "warn", "warning", "error":
+	default:
+		add("log_level", "unknown log level %q", c.LogLevel)
+	}
+
+	if len(c.Tenants) == 0 || !reflect.ValueOf(c.OAuth2Config).IsZero() { // optional default tenant with profiles
+		validateOAuth2(add, "oauth2_config", c.OAuth2Config)
+	}
+	tenants := map[string]bool{}
+	claimed := map[string]string{}
+	for i, t := range c.Tenants {
+		path := fmt.Sprintf("tenants.%d", i)
+		if t.Name == "" {
+			add(path+".name", "name is required")
+		} else if tenants[t.Name] {
+			add(path+".name", "duplicate tenant name %q", t.Name)
+		}
+		tenants[t.Name] = true
+		for j, d := range t.Domains {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if d == "" || strings.ContainsAny(d, "@ \t") {
+				add(fmt.Sprintf("%s.domains.%d", path, j), "invalid domain %q", d)
+			} else if other, ok := claimed[d]; ok {
+				add(fmt.Sprintf("%s.domains.%d", path, j), "domain %s is already used by tenant %q", d, other)
+			}
+			claimed[d] = t.Name
+		}
+		validateOAuth2(add, path, t.tOAuth2Config)
+	}
+
+	if len(c.Listeners) == 0 {
+		if c.ListenAddr == "" {
+			add("listen_addr", "listen_addr or listeners is required")
+		} else if err := checkAddr(c.ListenAddr); err != nil {
+			add("listen_addr", "%v", err)
+		}
+	} else if c.ListenAddr != "" {
+		add("listen_addr", "ignored because listeners are configured")
+	}
+	seen := map[string]bool{}
+	for i, lc := range c.Listeners {
+		path := fmt.Sprintf("listeners.%d", i)
+		if err := checkAddr(lc.Addr); err != nil {
+			add(path+".addr", "%v", err)
+		} else if seen[lc.Addr] {
+			add(path+".addr", "duplicate listener address %s", lc.Addr)
+		}
+		seen[lc.Addr] = true
+		lc.AuthMechanisms = append([]string{}, lc.AuthMechanisms...) // newListener normalizes in place
+		if _, err := newListener(lc); err != nil {
+			add(path, "%v", err)
+		}
+		if lc.Tenant != "" && !tenants[lc.Tenant] {
+			add(path+".tenant", "unknown tenant %q", lc.Tenant)
+		}
+		if lc.RequireAuth && lc.DefaultIdentity.Username != "" {
+			add(path+".default_identity", "unused because require_auth is set")
+		}
+	}
+
+	if c.AdminAddr != "" {
+		if err := checkAdminAddr(c.AdminAddr); err != nil {
+			add("admin_addr", "%v", err)
+		}
+	}
+	if a := c.HTTPAPI; a.ListenAddr != "" {
+		if err := checkAddr(a.ListenAddr); err != nil {
+			add("http_api.listen_addr", "%v", err)
+		}
+		if (a.TLSCert == "") != (a.TLSKey == "") {
+			add("http_api", "tls_cert and tls_key must be set together")
+		} else if a.TLSCert != "" {
+			if _, err := tls.LoadX509KeyPair(a.TLSCert, a.TLSKey); err != nil {
+				add("http_api.tls_cert", "failed to load TLS certificate: %v", err)
+			}
+		}
+		if len(a.APIKeys) == 0 && !a.AllowUserAuth {
+			add("http_api", "no api_keys and allow_user_auth is off, every request will be rejected")
+		}
+		for i, k := range a.APIKeys {
+			if len(k.Key) < 16 {
+				add(fmt.Sprintf("http_api.api_keys.%d.key", i), "API key %q is empty or shorter than 16 characters", k.Name)
+			}
+			if k.Identity.Username == "" {
+				add(fmt.Sprintf("http_api.api_keys.%d.identity", i), "API key %q has no identity", k.Name)
+			}
+		}
+	}
+
+	p := c.RecipientPolicy
+	for _, domains := range []struct {
+		name string
+		list []string
+	}{{"internal_domains", p.InternalDomains}, {"blocked_domains", p.BlockedDomains}} {
+		name := domains.name
+		for i, d := range domains.list {
+			if d == "" || strings.ContainsAny(d, "@ \t") {
+				add(fmt.Sprintf("recipient_policy.%s.%d", name, i), "invalid domain %q", d)
+			}
+		}
+	}
+	if len(p.InternalOnlySenders) > 0 && len(p.InternalDomains) == 0 {
+		add("recipient_policy.internal_only_senders", "internal_only_senders requires internal_domains")
+	}
+	if p.MaxRecipients < 0 {
+		add("recipient_policy.max_recipients", "must not be negative")
+	}
+
+	for i, r := range []tRateLimit{c.RateLimits.PerUser, c.RateLimits.PerIP, c.RateLimits.PerMailbox} {
+		if r.MessagesPerMinute < 0 || r.RecipientsPerMinute < 0 || r.MessagesPerDay < 0 || r.RecipientsPerDay < 0 {
+			add("rate_limits."+[]string{"per_user", "per_ip", "per_mailbox"}[i], "limits must not be negative")
+		}
+	}
+	durations := []struct {
+		path string
+		d    time.Duration
+	}{
+		{"timeouts.command", c.Timeouts.Command}, {"timeouts.data", c.Timeouts.Data}, {"timeouts.token", c.Timeouts.Token},
+		{"timeouts.mime", c.Timeouts.MIME}, {"timeouts.graph", c.Timeouts.Graph}, {"drain_timeout", c.DrainTimeout},
+		{"pickup.interval", c.Pickup.Interval}, {"auth_guard.failure_window", c.AuthGuard.FailureWindow},
+		{"auth_guard.lockout_duration", c.AuthGuard.LockoutDuration}, {"http_client.timeout", c.HTTPClient.Timeout},
+		{"http_client.dial_timeout", c.HTTPClient.DialTimeout}, {"http_client.tls_handshake_timeout", c.HTTPClient.TLSHandshakeTimeout},
+		{"http_client.response_header_timeout", c.HTTPClient.ResponseHeaderTimeout},
+		{"http_client.idle_conn_timeout", c.HTTPClient.IdleConnTimeout},
+	}
+	for _, d := range durations {
+		if d.d < 0 {
+			add(d.path, "must not be negative")
+		}
+	}
+	if c.MaxSessions < 0 || c.MaxSessionsPerIP < 0 {
+		add("max_sessions", "session limits must not be negative")
+	}
+	if c.MaxMessageSize < 0 {
+		add("max_message_size", "must not be negative")
+	}
+	if c.HTTPClient.ProxyURL != "" && c.HTTPClient.ProxyURL != "direct" {
+		if _, err := parseProxyURL(c.HTTPClient.ProxyURL); err != nil {
+			add("http_client.proxy_url", "%v", err)
+		}
+	}
+	if c.HTTPClient.CABundle != "" {
+		if _, err := loadCABundle(c.HTTPClient.CABundle); err != nil {
+			add("http_client.ca_bundle", "%v", err)
+		}
+	}
+	if c.PersistTokens && c.SpoolDir == "" {
+		add("persist_tokens", "persist_tokens requires spool_dir")
+	}
+
+	if c.Pickup.Dir != "" {
+		if fi, err := os.Stat(c.Pickup.Dir); err != nil || !fi.IsDir() {
+			add("pickup.dir", "%s is not a directory", c.Pickup.Dir)
+		}
+		if c.Pickup.Identity.Username == "" {
+			add("pickup.identity", "pickup requires an identity")
+		}
+	}
+	if c.Sendmail.RelayAddr != "" {
+		if err := checkAddr(c.Sendmail.RelayAddr); err != nil {
+			add("sendmail.relay_addr", "%v", err)
+		}
+	}
+	if c.Sendmail.RelayCA != "" {
+		if _, err := loadCABundle(c.Sendmail.RelayCA); err != nil {
+			add("sendmail.relay_ca", "%v", err)
+		}
+	}
+	return problems
+}
+
+// validateOAuth2 checks the app registration settings of oauth2_config or a tenant profile at path
+func validateOAuth2(add func(path, format string, args ...any), path string, o tOAuth2Config) {
+	if o.ClientID == "" {
+		add(path+".client_id", "client_id is required")
+	}
+	if o.ClientSecret == "" {
+		add(path+".client_secret", "client_secret is required")
+	}
+	if o.TenantID == "" {
+		add(path+".tenant_id", "tenant_id is required")
+	} else if !tenantIDPattern.MatchString(o.TenantID) {
+		add(path+".tenant_id", "tenant_id %q is neither a GUID nor a domain name", o.TenantID)
+	}
+	if len(o.Scopes) == 0 {
+		add(path+".scopes", "at least one scope is required, e.g. https://graph.microsoft.com/.default")
+	}
+	sendScope := false
+	for i, s := range o.Scopes {
+		if s == "" || strings.ContainsAny(s, " \t") {
+			add(fmt.Sprintf("%s.scopes.%d", path, i), "invalid scope %q", s)
+		}
+		if strings.HasSuffix(s, "/.default") || strings.HasSuffix(strings.ToLower(s), "mail.send") {
+			sendScope = true
+		}
+	}
+	if len(o.Scopes) > 0 && !sendScope {
+		add(path+".scopes", "no .default or Mail.Send scope, Graph sendMail will be denied")
+	}
+}
+
+// checkAddr validates a host:port or unix:/path address
+func checkAddr(addr string) error {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return errors.New("empty unix socket path")
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port in address %q", addr)
+	}
+	return nil
+}
+
+// liveIdentity returns the first configured identity that can be used for a test token acquisition
+func liveIdentity(c *tConfig) (tIdentity, bool) {
+	candidates := []tIdentity{{Username: c.FallbackSMTPuser, Password: c.FallbackSMTPpass}, c.Sendmail.Identity, c.Pickup.Identity}
+	for _, l := range c.Listeners {
+		candidates = append(candidates, l.DefaultIdentity)
+	}
+	for _, k := range c.HTTPAPI.APIKeys {
+		candidates = append(candidates, k.Identity)
+	}
+	for _, id := range candidates {
+		if id.Username != "" && id.Password != "" {
+			return id, true
+		}
+	}
+	return tIdentity{}, false
+}
+
+// checkConfigMain runs -check-config and returns the process exit code
+func checkConfigMain(path string, live bool) int {
+	fmt.Printf("Checking %s\n", path)
+	c, problems := checkConfigFile(path)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if c != nil && live && len(problems) == 0 {
+		if id, ok := liveIdentity(c); !ok {
+			fmt.Println("live check skipped: no identity with a password is configured")
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			_, oc, err := selectTenant(c, "", id.Username)
+			if err == nil {
+				_, err = getOAuth2TokenWithExpiry(ctx, oc, id.Username, id.Password)
+			}
+			if err != nil {
+				problems = append(problems, configProblem{Path: "oauth2_config", Msg: fmt.Sprintf("token acquisition for %s failed (%s): %v", id.Username, classifyAuthError(err), err)})
+				fmt.Println(problems[len(problems)-1])
+			} else {
+				fmt.Printf("live check: token acquired for %s\n", id.Username)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found\n", len(problems))
+		return 1
+	}
+	fmt.Println("Configuration OK")
+	return 0
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte(`log_level: info
+listen_addr: 127.0.0.1:2526
+oauth2_config:
+    client_id: id
+    client_secret: secret
+    tenant_id: contoso.onmicrosoft.com
+    scopes:
+        - https://graph.microsoft.com/.default
+recipient_policy:
+    max_recipent: 3
+listeners:
+    - addr: ":2525"
+      tls: starttls
+      tls_cert: /nonexistent/cert.pem
+`), 0600)
+
+	c, problems := checkConfigFile(path)
+	if c == nil {
+		t.Fatalf("expected a config, got problems %v", problems)
+	}
+	var lines []string
+	for _, p := range problems {
+		lines = append(lines, p.String())
+	}
+	out := strings.Join(lines, "\n")
+	for _, want := range []string{
+		"line 10: field max_recipent not found",
+		"line 2: listen_addr: ignored because listeners are configured",
+		"line 12: listeners.0: listener :2525: failed to load TLS certificate",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in problems:\n%s", want, out)
+		}
+	}
+	if len(problems) != 3 {
+		t.Errorf("expected 3 problems, got:\n%s", out)
+	}
+
+	os.WriteFile(path, []byte("listen_addr: [\n"), 0600)
+	if c, problems := checkConfigFile(path); c != nil || len(problems) != 1 || problems[0].Line == 0 {
+		t.Errorf("expected one syntax error with line number, got %v", problems)
+	}
+}
+
+func TestCheckAddr(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:2526", ":25", "[::1]:587", "unix:/run/azsmtp.sock"} {
+		if err := checkAddr(addr); err != nil {
+			t.Errorf("expected %s to be valid, got %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"", "localhost", "127.0.0.1:smtp", ":70000", "unix:"} {
+		if err := checkAddr(addr); err == nil {
+			t.Errorf("expected %s to be invalid", addr)
+		}
+	}
+}
+
+func TestCheckAdminAddr(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:2527", "[::1]:2527", "localhost:2527"} {
+		if err := checkAdminAddr(addr); err != nil {
+			t.Errorf("expected %s to be allowed, got %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"0.0.0.0:2527", ":2527", "10.0.0.1:2527", "[::]:2527", "admin.example.com:2527"} {
+		if err := checkAdminAddr(addr); err == nil {
+			t.Errorf("expected %s to be rejected", addr)
+		}
+	}
+}
@@ -1,23 +1,46 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Config holds the relay and upstream SMTP configuration
 type tConfig struct {
-	Log              string        `yaml:"log"`
-	LogLevel         string        `yaml:"log_level"`
-	ListenAddr       string        `yaml:"listen_addr"`
-	OAuth2Config     tOAuth2Config `yaml:"oauth2_config"`
-	FallbackSMTPuser string        `yaml:"fallback_smtp_user"`
-	FallbackSMTPpass string        `yaml:"fallback_smtp_pass"`
-	SaveToSent       bool          `yaml:"save_to_sent"`
+	Log                 string            `yaml:"log"`
+	LogLevel            string            `yaml:"log_level"`
+	ListenAddr          string            `yaml:"listen_addr"`
+	Listeners           []tListenerConfig `yaml:"listeners"`
+	OAuth2Config        tOAuth2Config     `yaml:"oauth2_config"`
+	Tenants             []tTenantConfig   `yaml:"tenants"`
+	FallbackSMTPuser    string            `yaml:"fallback_smtp_user"`
+	FallbackSMTPpass    string            `yaml:"fallback_smtp_pass"`
+	SaveToSent          bool              `yaml:"save_to_sent"`
+	RecipientPolicy     tRecipientPolicy  `yaml:"recipient_policy"`
+	AuthGuard           tAuthGuardConfig  `yaml:"auth_guard"`
+	AdminAddr           string            `yaml:"admin_addr"`
+	RateLimits          tRateLimitsConfig `yaml:"rate_limits"`
+	SpoolDir            string            `yaml:"spool_dir"`
+	PersistTokens       bool              `yaml:"persist_tokens"`
+	Timeouts            tTimeoutsConfig   `yaml:"timeouts"`
+	MaxSessions         int               `yaml:"max_sessions"`
+	MaxSessionsPerIP    int               `yaml:"max_sessions_per_ip"`
+	MaxMessageSize      int64             `yaml:"max_message_size"` // bytes, advertised as SIZE
+	DrainTimeout        time.Duration     `yaml:"drain_timeout"`
+	ConfigWatchInterval time.Duration     `yaml:"config_watch_interval"`
+	HTTPAPI             tHTTPAPIConfig    `yaml:"http_api"`
+	HTTPClient          tHTTPClientConfig `yaml:"http_client"`
+	Pickup              tPickupConfig     `yaml:"pickup"`
+	Sendmail            tSendmailConfig   `yaml:"sendmail"`
 }
 
 // OAuth2Config holds OAuth2 client configuration
@@ -28,25 +51,88 @@ type tOAuth2Config struct {
 	Scopes       []string `yaml:"scopes"`
 }
 
+// configPtr holds the active config; a reload swaps it, so read it once per session or request with getConfig
+var configPtr atomic.Pointer[tConfig]
+
+func getConfig() *tConfig {
+	return configPtr.Load()
+}
+
+func setConfig(c *tConfig) {
+	configPtr.Store(c)
+}
+
+// executableDir is the directory of the executable, after symlinks (e.g. /usr/sbin/sendmail) are resolved
+func executableDir() string {
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		exe = os.Args[0]
+	}
+	return filepath.Dir(exe)
+}
+
+// defaultConfigFile is config.yaml next to the executable
+func defaultConfigFile() string {
+	return filepath.Join(executableDir(), "config.yaml")
+}
+
+// resolveConfigFile returns the config file path: the -config flag, then AZSMTP_CONFIG, then the default
+func resolveConfigFile(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if env := os.Getenv(envConfigFile); env != "" {
+		return env
+	}
+	return defaultConfigFile()
+}
+
+// readConfigFile parses the config file without environment overrides or decryption.
+// A missing default config file yields an empty config so the relay can be configured from the environment only.
+func readConfigFile(path string) (*tConfig, error) {
+	c := &tConfig{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && path == defaultConfigFile() {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadConfig loads configFile, applies the AZSMTP_* environment overrides and resolves secret references.
+// Precedence (highest first): environment variables, config file, built-in defaults.
 func loadConfig() error {
-	data, err := os.ReadFile(filepath.Join(filepath.Dir(os.Args[0]), "config.yaml"))
+	c, err := readConfigFile(configFile)
 	if err != nil {
 		return err
 	}
-	config = &tConfig{} // Allocate the struct before unmarshalling
-	err = yaml.Unmarshal(data, config)
-	if err != nil {
+	if err := applyEnvOverrides(c); err != nil {
+		return err
+	}
+	if err := resolveSecretRefs(c); err != nil {
 		return err
 	}
-	decryptConfigStrings()
+	if err := decryptConfigStrings(c); err != nil {
+		return fmt.Errorf("failed to decrypt config: %w", err)
+	}
+	setConfig(c)
 	return nil
 }
 
 func slogSetup() (err error) {
-	if config.Log != "" {
-		logPath := config.Log
-		if filepath.Base(config.Log) == config.Log {
-			logPath = filepath.Join(filepath.Dir(os.Args[0]), config.Log)
+	c := getConfig()
+	if c.Log != "" {
+		logPath := c.Log
+		if filepath.Base(c.Log) == c.Log {
+			logPath = filepath.Join(executableDir(), c.Log)
 		}
 		logFile, err = os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 		if err != nil {
@@ -55,25 +141,68 @@ func slogSetup() (err error) {
 	} else {
 		logFile = os.Stdout
 	}
-	if config.LogLevel == "" {
-		config.LogLevel = "info"
-	}
-	var level slog.Level
-	switch strings.ToLower(config.LogLevel) {
+	logLevel.Set(parseLogLevel(c.LogLevel))
+	logger = slog.New(slog.NewTextHandler(logFile, &slog.HandlerOptions{
+		Level: logLevel,
+	}))
+	return nil
+}
+
+// logLevel is shared by the handler so a config reload can change it
+var logLevel = new(slog.LevelVar)
+
+func parseLogLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
 	case "debug":
-		level = slog.LevelDebug
-	case "info":
-		level = slog.LevelInfo
+		return slog.LevelDebug
 	case "warn", "warning":
-		level = slog.LevelWarn
+		return slog.LevelWarn
 	case "error":
-		level = slog.LevelError
-	default:
-		level = slog.LevelInfo
+		return slog.LevelError
 	}
+	return slog.LevelInfo
+}
 
-	logger = slog.New(slog.NewTextHandler(logFile, &slog.HandlerOptions{
-		Level: level,
-	}))
-	return nil
+// forEachSecret replaces every secret config string (credentials, client secret, identity passwords,
+// API keys) with the result of fn
+func forEachSecret(c *tConfig, fn func(string) (string, error)) error {
+	var err error
+	apply := func(s *string) {
+		if err == nil && *s != "" {
+			*s, err = fn(*s)
+		}
+	}
+	apply(&c.FallbackSMTPuser)
+	apply(&c.FallbackSMTPpass)
+	apply(&c.OAuth2Config.ClientID)
+	apply(&c.OAuth2Config.ClientSecret)
+	apply(&c.OAuth2Config.TenantID)
+	for i := range c.Tenants {
+		apply(&c.Tenants[i].ClientID)
+		apply(&c.Tenants[i].ClientSecret)
+		apply(&c.Tenants[i].TenantID)
+	}
+	for i := range c.Listeners {
+		apply(&c.Listeners[i].DefaultIdentity.Password)
+		for k, ident := range c.Listeners[i].PeerIdentities {
+			apply(&ident.Password)
+			c.Listeners[i].PeerIdentities[k] = ident
+		}
+	}
+	for i := range c.HTTPAPI.APIKeys {
+		apply(&c.HTTPAPI.APIKeys[i].Key)
+		apply(&c.HTTPAPI.APIKeys[i].Identity.Password)
+	}
+	apply(&c.Pickup.Identity.Password)
+	apply(&c.Sendmail.Identity.Password)
+	return err
+}
+
+// writeConfigFile writes c back to path, used by -encrypt, -decrypt and -rotate-key
+func writeConfigFile(path string, c *tConfig) error {
+	marshaled, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, marshaled, 0600)
 }
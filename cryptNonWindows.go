@@ -3,28 +3,294 @@
 package main
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
-	"log"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 )
 
-type DPAPI struct {
+// Config strings are encrypted with AES-256-GCM. The key comes from AZSMTP_SECRET_PASSPHRASE (PBKDF2)
+// if set, otherwise from a key file readable by the owner only, created by the first -encrypt.
+const (
+	encryptedPrefix        = "__SYSTEMENCRYPTED__"
+	envSecretKeyFile       = "AZSMTP_SECRET_KEY_FILE"
+	envSecretPassphrase    = "AZSMTP_SECRET_PASSPHRASE"
+	envSecretNewPassphrase = "AZSMTP_SECRET_NEW_PASSPHRASE"
+	pbkdf2Iterations       = 600000
+
+	secretModeKeyFile    byte = 1 // mode | key id (4) | nonce | ciphertext
+	secretModePassphrase byte = 2 // mode | salt (16) | nonce | ciphertext
+)
+
+type tSecretBox struct {
+	keyFile    string
+	key        []byte // loaded on first use
+	passphrase string
+	salt       []byte            // salt of values encrypted by this box
+	derived    map[string][]byte // salt -> key, PBKDF2 is deliberately slow
+}
+
+func newSecretBox() *tSecretBox {
+	return &tSecretBox{keyFile: secretKeyFile(), passphrase: os.Getenv(envSecretPassphrase)}
+}
+
+// secretKeyFile returns AZSMTP_SECRET_KEY_FILE or secret.key next to the config file
+func secretKeyFile() string {
+	if path := os.Getenv(envSecretKeyFile); path != "" {
+		return path
+	}
+	return filepath.Join(filepath.Dir(configFile), "secret.key")
+}
+
+// loadKeyFile reads a hex encoded 256-bit key, refusing files accessible by group or others
+func loadKeyFile(path string) ([]byte, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("secret key file: %w", err)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("secret key file %s must not be accessible by group or others (mode %v)", path, fi.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("secret key file: %w", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("secret key file %s must hold a hex encoded 256-bit key", path)
+	}
+	return key, nil
+}
+
+// writeKeyFile creates a new random key file; an existing file is never overwritten
+func writeKeyFile(path string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secret key file: %w", err)
+	}
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(key)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return key, f.Close()
+}
+
+func keyID(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:4]
+}
+
+func (b *tSecretBox) fileKey(create bool) ([]byte, error) {
+	if b.key != nil {
+		return b.key, nil
+	}
+	key, err := loadKeyFile(b.keyFile)
+	if errors.Is(err, os.ErrNotExist) && create {
+		key, err = writeKeyFile(b.keyFile)
+	}
+	b.key = key
+	return key, err
+}
+
+func (b *tSecretBox) passphraseKey(salt []byte) ([]byte, error) {
+	if b.passphrase == "" {
+		return nil, fmt.Errorf("value was encrypted with a passphrase, set %s", envSecretPassphrase)
+	}
+	if key, ok := b.derived[string(salt)]; ok {
+		return key, nil
+	}
+	key, err := pbkdf2.Key(sha256.New, b.passphrase, salt, pbkdf2Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	if b.derived == nil {
+		b.derived = map[string][]byte{}
+	}
+	b.derived[string(salt)] = key
+	return key, nil
+}
+
+// seal encrypts s; the header is authenticated as additional data
+func (b *tSecretBox) seal(s string) (string, error) {
+	var header, key []byte
+	var err error
+	if b.passphrase != "" {
+		if b.salt == nil {
+			b.salt = make([]byte, 16)
+			if _, err := rand.Read(b.salt); err != nil {
+				return "", err
+			}
+		}
+		if key, err = b.passphraseKey(b.salt); err != nil {
+			return "", err
+		}
+		header = append([]byte{secretModePassphrase}, b.salt...)
+	} else {
+		if key, err = b.fileKey(true); err != nil {
+			return "", err
+		}
+		header = append([]byte{secretModeKeyFile}, keyID(key)...)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := append(append(header, nonce...), gcm.Seal(nil, nonce, []byte(s), header)...)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(out), nil
+}
+
+// open decrypts a value produced by seal
+func (b *tSecretBox) open(s string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, encryptedPrefix))
+	if err != nil || len(data) < 1 {
+		return "", errors.New("invalid encrypted value")
+	}
+	var headerLen int
+	var key []byte
+	switch data[0] {
+	case secretModeKeyFile:
+		headerLen = 5
+		if key, err = b.fileKey(false); err != nil {
+			return "", err
+		}
+		if len(data) >= headerLen && !bytes.Equal(data[1:5], keyID(key)) {
+			return "", fmt.Errorf("value was encrypted with another key than %s", b.keyFile)
+		}
+	case secretModePassphrase:
+		headerLen = 17
+		if len(data) < headerLen {
+			return "", errors.New("invalid encrypted value")
+		}
+		if key, err = b.passphraseKey(data[1:17]); err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.New("encrypted value is not supported on this platform (Windows DPAPI?)")
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < headerLen+gcm.NonceSize() {
+		return "", errors.New("invalid encrypted value")
+	}
+	nonce := data[headerLen : headerLen+gcm.NonceSize()]
+	plain, err := gcm.Open(nil, nonce, data[headerLen+gcm.NonceSize():], data[:headerLen])
+	if err != nil {
+		return "", errors.New("failed to decrypt value, wrong key or passphrase")
+	}
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptConfigStrings(c *tConfig) error {
+	return encryptWith(c, newSecretBox())
+}
+
+func encryptWith(c *tConfig, b *tSecretBox) error {
+	return forEachSecret(c, func(s string) (string, error) {
+		if strings.HasPrefix(s, encryptedPrefix) || isSecretRef(s) {
+			return s, nil // Already encrypted or stored elsewhere
+		}
+		return b.seal(s)
+	})
 }
 
-func encryptConfigStrings() {
-	log.Fatal("Encryption is not supported on non-Windows platforms")
+func decryptConfigStrings(c *tConfig) error {
+	b := newSecretBox()
+	return forEachSecret(c, func(s string) (string, error) {
+		if !strings.HasPrefix(s, encryptedPrefix) {
+			return s, nil
+		}
+		return b.open(s)
+	})
 }
 
-func decryptConfigStrings() {
+// stateBox encrypts state files such as the persisted token cache; one box keeps the derived key
+var stateBox struct {
+	sync.Mutex
+	b *tSecretBox
 }
 
-func NewDPAPI() *DPAPI {
-	return nil
+func sealState(data []byte) (string, error) {
+	stateBox.Lock()
+	defer stateBox.Unlock()
+	if stateBox.b == nil {
+		stateBox.b = newSecretBox()
+	}
+	return stateBox.b.seal(string(data))
 }
 
-func (d *DPAPI) Encrypt(data, entropy []byte, localMachine bool) (string, error) {
-	return "", errors.New("Encryption is not supported on non-Windows platforms")
+func openState(s string) ([]byte, error) {
+	stateBox.Lock()
+	defer stateBox.Unlock()
+	if stateBox.b == nil {
+		stateBox.b = newSecretBox()
+	}
+	plain, err := stateBox.b.open(s)
+	return []byte(plain), err
 }
 
-func (d *DPAPI) Decrypt(data string, entropy []byte) ([]byte, error) {
-	return nil, errors.New("Decryption is not supported on non-Windows platforms")
+// rotateSecretKey re-encrypts the config file with a new key file, or with AZSMTP_SECRET_NEW_PASSPHRASE
+// in passphrase mode. The previous key file is kept as <key file>.old.
+func rotateSecretKey(path string) error {
+	c, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if err := decryptConfigStrings(c); err != nil {
+		return err
+	}
+	if os.Getenv(envSecretPassphrase) != "" {
+		newPassphrase := os.Getenv(envSecretNewPassphrase)
+		if newPassphrase == "" {
+			return fmt.Errorf("set the new passphrase in %s", envSecretNewPassphrase)
+		}
+		if err := encryptWith(c, &tSecretBox{passphrase: newPassphrase}); err != nil {
+			return err
+		}
+		return writeConfigFile(path, c)
+	}
+	keyFile := secretKeyFile()
+	newKeyFile := keyFile + ".new"
+	os.Remove(newKeyFile) // left over from an interrupted rotation, the config still uses the old key
+	key, err := writeKeyFile(newKeyFile)
+	if err != nil {
+		return err
+	}
+	if err := encryptWith(c, &tSecretBox{keyFile: newKeyFile, key: key}); err != nil {
+		return err
+	}
+	if err := writeConfigFile(path, c); err != nil {
+		return err
+	}
+	if err := os.Rename(keyFile, keyFile+".old"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Rename(newKeyFile, keyFile)
 }
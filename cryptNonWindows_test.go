@@ -0,0 +1,92 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretKeyFileRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(envSecretKeyFile, filepath.Join(dir, "secret.key"))
+	t.Setenv(envSecretPassphrase, "")
+	c := &tConfig{OAuth2Config: tOAuth2Config{ClientSecret: "s3cret"}, Pickup: tPickupConfig{Identity: tIdentity{Username: "app@domain.com", Password: "pw"}}}
+	if err := encryptConfigStrings(c); err != nil {
+		t.Fatalf("encryptConfigStrings failed: %v", err)
+	}
+	if !strings.HasPrefix(c.OAuth2Config.ClientSecret, encryptedPrefix) || !strings.HasPrefix(c.Pickup.Identity.Password, encryptedPrefix) {
+		t.Fatalf("expected encrypted values, got %+v", c)
+	}
+	if c.Pickup.Identity.Username != "app@domain.com" {
+		t.Errorf("expected username to stay in plaintext")
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "secret.key")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected key file with mode 0600, got %v %v", fi, err)
+	}
+	if err := decryptConfigStrings(c); err != nil || c.OAuth2Config.ClientSecret != "s3cret" || c.Pickup.Identity.Password != "pw" {
+		t.Errorf("expected decrypted values, got %+v %v", c, err)
+	}
+
+	os.Chmod(filepath.Join(dir, "secret.key"), 0644)
+	c.OAuth2Config.ClientSecret = encryptedPrefix + "AQ=="
+	if err := decryptConfigStrings(c); err == nil || !strings.Contains(err.Error(), "group or others") {
+		t.Errorf("expected error for world-readable key file, got %v", err)
+	}
+}
+
+func TestSecretPassphrase(t *testing.T) {
+	t.Setenv(envSecretKeyFile, filepath.Join(t.TempDir(), "secret.key"))
+	t.Setenv(envSecretPassphrase, "correct horse")
+	c := &tConfig{FallbackSMTPpass: "pw"}
+	if err := encryptConfigStrings(c); err != nil {
+		t.Fatalf("encryptConfigStrings failed: %v", err)
+	}
+	encrypted := c.FallbackSMTPpass
+	t.Setenv(envSecretPassphrase, "wrong")
+	if err := decryptConfigStrings(c); err == nil {
+		t.Errorf("expected error for wrong passphrase")
+	}
+	t.Setenv(envSecretPassphrase, "correct horse")
+	c.FallbackSMTPpass = encrypted
+	if err := decryptConfigStrings(c); err != nil || c.FallbackSMTPpass != "pw" {
+		t.Errorf("expected decrypted value, got '%s' %v", c.FallbackSMTPpass, err)
+	}
+}
+
+func TestRotateSecretKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "secret.key")
+	path := filepath.Join(dir, "config.yaml")
+	t.Setenv(envSecretKeyFile, keyFile)
+	t.Setenv(envSecretPassphrase, "")
+	c := &tConfig{OAuth2Config: tOAuth2Config{ClientSecret: "s3cret"}}
+	if err := encryptConfigStrings(c); err != nil {
+		t.Fatalf("encryptConfigStrings failed: %v", err)
+	}
+	writeConfigFile(path, c)
+	oldKey, _ := os.ReadFile(keyFile)
+
+	if err := rotateSecretKey(path); err != nil {
+		t.Fatalf("rotateSecretKey failed: %v", err)
+	}
+	newKey, _ := os.ReadFile(keyFile)
+	if string(newKey) == string(oldKey) {
+		t.Errorf("expected a new key file")
+	}
+	if backup, _ := os.ReadFile(keyFile + ".old"); string(backup) != string(oldKey) {
+		t.Errorf("expected the old key to be kept as .old")
+	}
+	rotated, err := readConfigFile(path)
+	if err != nil {
+		t.Fatalf("readConfigFile failed: %v", err)
+	}
+	if rotated.OAuth2Config.ClientSecret == c.OAuth2Config.ClientSecret {
+		t.Errorf("expected the value to be re-encrypted")
+	}
+	if err := decryptConfigStrings(rotated); err != nil || rotated.OAuth2Config.ClientSecret != "s3cret" {
+		t.Errorf("expected the new key to decrypt, got '%s' %v", rotated.OAuth2Config.ClientSecret, err)
+	}
+}
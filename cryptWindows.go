@@ -20,13 +20,14 @@ type dpapiDataBlob struct {
 	pbData *byte
 }
 
-func encryptConfigStrings() {
+func encryptConfigStrings(c *tConfig) error {
 	d := NewDPAPI()
-	config.FallbackSMTPuser = confStringEncrypt(config.FallbackSMTPuser, d)
-	config.FallbackSMTPpass = confStringEncrypt(config.FallbackSMTPpass, d)
-	config.OAuth2Config.ClientID = confStringEncrypt(config.OAuth2Config.ClientID, d)
-	config.OAuth2Config.ClientSecret = confStringEncrypt(config.OAuth2Config.ClientSecret, d)
-	config.OAuth2Config.TenantID = confStringEncrypt(config.OAuth2Config.TenantID, d)
+	return forEachSecret(c, func(s string) (string, error) {
+		if isSecretRef(s) {
+			return s, nil
+		}
+		return confStringEncrypt(s, d), nil
+	})
 }
 
 func confStringEncrypt(c string, d *DPAPI) string {
@@ -40,13 +41,32 @@ func confStringEncrypt(c string, d *DPAPI) string {
 	return "__SYSTEMENCRYPTED__" + enc
 }
 
-func decryptConfigStrings() {
+func decryptConfigStrings(c *tConfig) error {
 	d := NewDPAPI()
-	config.FallbackSMTPuser = confStringDecrypt(config.FallbackSMTPuser, d)
-	config.FallbackSMTPpass = confStringDecrypt(config.FallbackSMTPpass, d)
-	config.OAuth2Config.ClientID = confStringDecrypt(config.OAuth2Config.ClientID, d)
-	config.OAuth2Config.ClientSecret = confStringDecrypt(config.OAuth2Config.ClientSecret, d)
-	config.OAuth2Config.TenantID = confStringDecrypt(config.OAuth2Config.TenantID, d)
+	return forEachSecret(c, func(s string) (string, error) {
+		return confStringDecrypt(s, d), nil
+	})
+}
+
+// rotateSecretKey is not needed with DPAPI, the machine key is managed by Windows
+func rotateSecretKey(path string) error {
+	return errors.New("-rotate-key is not supported with DPAPI, the key is managed by Windows")
+}
+
+// sealState encrypts state files such as the persisted token cache with DPAPI
+func sealState(data []byte) (string, error) {
+	enc, err := NewDPAPI().Encrypt(data, []byte("smtps@wAppX1829"), true)
+	if err != nil {
+		return "", err
+	}
+	return "__SYSTEMENCRYPTED__" + enc, nil
+}
+
+func openState(s string) ([]byte, error) {
+	if len(s) < 19 || s[:19] != "__SYSTEMENCRYPTED__" {
+		return nil, errors.New("not encrypted with DPAPI")
+	}
+	return NewDPAPI().Decrypt(s[19:], []byte("smtps@wAppX1829"))
 }
 
 func confStringDecrypt(c string, d *DPAPI) string {
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+)
+
+// tMessage is a parsed message ready for delivery through Graph, whatever way it was submitted
+type tMessage struct {
+	ID          string
+	Source      string // smtp, lmtp, http, ...
+	Username    string // mailbox used for the token and the Graph sendMail URL
+	Password    string // "" once a renewable token is cached for Cred
+	Cred        []byte // credHash of the password, nil to hash Password
+	Tenant      string // tenant profile forced by the listener, "" selects by username
+	ClientIP    string
+	MailFrom    string
+	RcptTo      []string
+	To, Cc, Bcc []string // RcptTo split as Graph shows them; envelope recipients not in the To or Cc headers are Bcc
+	Subject     string
+	Body        string
+	IsHTML      bool
+	Attachments []Attachment
+}
+
+// forgetPassword keeps only the hash of m.Password once a renewable token is cached for it
+func (m *tMessage) forgetPassword() {
+	if h := credHash(m.Password); m.Password != "" && renewableWithoutPassword(m.Tenant, m.Username, h) {
+		m.Cred, m.Password = h, ""
+	}
+}
+
+// deliveryError is a failed submission or delivery together with the SMTP reply describing it
+type deliveryError struct {
+	Reply string
+	Err   error
+}
+
+func (e *deliveryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *deliveryError) Unwrap() error {
+	return e.Err
+}
+
+// temporary reports whether the client should retry later (4xx reply)
+func (e *deliveryError) temporary() bool {
+	return strings.HasPrefix(e.Reply, "4")
+}
+
+// newMessageID returns a random identifier used in replies and logs
+func newMessageID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// messageSize returns the size of the content of a message with the attachments decoded
+func messageSize(m *tMessage) int64 {
+	size := int64(len(m.Subject) + len(m.Body))
+	for _, a := range m.Attachments {
+		size += int64(base64.StdEncoding.DecodedLen(len(a.Content)))
+	}
+	return size
+}
+
+// normalizeLineEndings converts any mix of CR, LF and CRLF to CRLF for MIME parsing
+func normalizeLineEndings(msg string) string {
+	msg = strings.ReplaceAll(msg, "\r\n", "\n")
+	msg = strings.ReplaceAll(msg, "\r", "\n")
+	return strings.ReplaceAll(msg, "\n", "\r\n")
+}
+
+// parseMessage parses a raw RFC 5322 message into m within the mime stage deadline
+func parseMessage(ctx context.Context, m *tMessage, raw string) error {
+	ctx, cancel := stageContext(ctx, getConfig().Timeouts.MIME, defaultMIMETimeout)
+	defer cancel()
+	subject, body, isHTML, attachments, err := parseSubjectBodyAndAttachments(ctx, normalizeLineEndings(raw))
+	if reply := interruptedReply(err); reply != "" {
+		return &deliveryError{Reply: reply, Err: context.Cause(ctx)}
+	}
+	if err != nil {
+		return &deliveryError{Reply: "550 5.6.0 Message parsing failed: " + err.Error(), Err: err}
+	}
+	m.Subject, m.Body, m.IsHTML, m.Attachments = subject, body, isHTML, attachments
+	m.To, m.Cc, m.Bcc = splitRecipients(normalizeLineEndings(raw), m.RcptTo)
+	return nil
+}
+
+// splitRecipients sorts the envelope recipients by the To and Cc headers of raw. The others
+// are blind copies and must not be shown to the other recipients.
+func splitRecipients(raw string, rcptTo []string) (to, cc, bcc []string) {
+	inHeader := func(field string) map[string]bool {
+		found := make(map[string]bool)
+		msg, err := mail.ReadMessage(strings.NewReader(raw))
+		if err != nil {
+			return found
+		}
+		addrs, _ := msg.Header.AddressList(field)
+		for _, a := range addrs {
+			found[strings.ToLower(a.Address)] = true
+		}
+		return found
+	}
+	toHeader, ccHeader := inHeader("To"), inHeader("Cc")
+	for _, addr := range rcptTo {
+		switch key := strings.ToLower(addr); {
+		case toHeader[key]:
+			to = append(to, addr)
+		case ccHeader[key]:
+			cc = append(cc, addr)
+		default:
+			bcc = append(bcc, addr)
+		}
+	}
+	return to, cc, bcc
+}
+
+// checkMessagePolicy applies the recipient policy and rate limits to a message submitted
+// without an SMTP dialogue. Rejected recipients fail the whole message.
+func checkMessagePolicy(m *tMessage) error {
+	if len(m.RcptTo) == 0 {
+		return &deliveryError{Reply: "503 5.5.1 No valid recipients", Err: errors.New("no recipients")}
+	}
+	c := getConfig()
+	for i, addr := range m.RcptTo {
+		if reply := checkRecipient(c.RecipientPolicy, m.Username, addr, i); reply != "" {
+			logger.Warn("Recipient rejected by policy", "id", m.ID, "source", m.Source, "username", m.Username, "rcptTo", addr, "reply", reply)
+			return &deliveryError{Reply: reply, Err: fmt.Errorf("recipient %s rejected: %s", addr, reply)}
+		}
+	}
+	if reason, ok := rateLimiter.allow(rateLimitKeys(c.RateLimits, m.Username, m.ClientIP, m.Username), len(m.RcptTo)); !ok {
+		logger.Warn("Message rejected by rate limit", "id", m.ID, "source", m.Source, "username", m.Username, "ip", m.ClientIP, "rcptTo", m.RcptTo, "reason", reason)
+		return &deliveryError{Reply: "451 4.7.1 Rate limit exceeded, try again later", Err: fmt.Errorf("rate limit exceeded: %s", reason)}
+	}
+	return nil
+}
+
+// deliverMessage gets a token for the message's identity and sends it via Graph, each stage within its
+// deadline. Cancelling ctx (client gone, service stopping) aborts the calls in flight.
+func deliverMessage(ctx context.Context, m *tMessage) error {
+	timeouts := getConfig().Timeouts
+	tctx, cancel := stageContext(ctx, timeouts.Token, defaultTokenTimeout)
+	cred := m.Cred
+	if cred == nil {
+		cred = credHash(m.Password)
+	}
+	token, err := getOAuth2TokenForCred(tctx, m.Tenant, m.Username, cred, m.Password)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to get OAuth2 token", "id", m.ID, "source", m.Source, "error", err, "cause", context.Cause(tctx), "username", m.Username)
+		if reply := interruptedReply(err); reply != "" {
+			return &deliveryError{Reply: reply, Err: err}
+		}
+		// Retrying with rejected credentials only feeds smart lockout, so those failures are permanent
+		switch classifyAuthError(err) {
+		case authErrCredentials:
+			return &deliveryError{Reply: "550 5.7.8 Authentication credentials invalid", Err: err}
+		case authErrMFA:
+			return &deliveryError{Reply: "550 5.7.9 MFA or Conditional Access required for the sending identity", Err: err}
+		}
+		return &deliveryError{Reply: "451 4.7.0 Temporary authentication failure", Err: err}
+	}
+	gctx, cancel := stageContext(ctx, timeouts.Graph, defaultGraphTimeout)
+	to, cc, bcc := m.To, m.Cc, m.Bcc
+	if len(to)+len(cc)+len(bcc) == 0 { // not split, don't disclose anybody
+		bcc = m.RcptTo
+	}
+	err = sendMailGraphAPI(gctx, token, m.Username, m.MailFrom, to, cc, bcc, m.Subject, m.Body, m.IsHTML, m.Attachments)
+	cancel()
+	if err != nil {
+		logger.Error("Failed to send email via Graph API", "id", m.ID, "source", m.Source, "error", err, "cause", context.Cause(gctx), "username", m.Username, "mailFrom", m.MailFrom, "rcptTo", m.RcptTo)
+		if reply := interruptedReply(err); reply != "" {
+			return &deliveryError{Reply: reply, Err: err}
+		}
+		// The Graph error body goes to the log only, the client gets a fixed reply
+		var ge *graphError
+		switch {
+		case errors.As(err, &ge) && ge.Status == http.StatusTooManyRequests:
+			return &deliveryError{Reply: "451 4.7.1 Throttled by Graph, try again later", Err: err}
+		case errors.As(err, &ge) && ge.temporary():
+			return &deliveryError{Reply: "451 4.3.0 Graph temporarily unavailable, try again later", Err: err}
+		case errors.As(err, &ge):
+			return &deliveryError{Reply: "550 5.7.0 Delivery failed, rejected by Graph", Err: err}
+		}
+		return &deliveryError{Reply: "451 4.4.0 Graph not reachable, try again later", Err: err}
+	}
+	logger.Info("E-mail sent successfully", "id", m.ID, "source", m.Source, "username", m.Username, "mailFrom", m.MailFrom, "rcptTo", m.RcptTo, "subject", m.Subject)
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGraph records the sendMail requests of fakeGraphEndpoint
+type fakeGraph struct {
+	mu       sync.Mutex
+	requests int
+	posted   map[string]any // last message posted
+}
+
+func (g *fakeGraph) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.requests
+}
+
+// fakeGraphEndpoint answers sendMail with status and body
+func fakeGraphEndpoint(t *testing.T, status int, body string) *fakeGraph {
+	t.Helper()
+	g := &fakeGraph{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.mu.Lock()
+		g.requests++
+		json.NewDecoder(r.Body).Decode(&g.posted)
+		g.mu.Unlock()
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	saved := graphSendMailURLFormat
+	graphSendMailURLFormat = srv.URL + "/v1.0/users/%s/sendMail"
+	t.Cleanup(func() {
+		srv.Close()
+		graphSendMailURLFormat = saved
+	})
+	return g
+}
+
+func TestDeliverMessage_GraphErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		reply  string
+	}{
+		{http.StatusAccepted, ""},
+		{http.StatusTooManyRequests, "451 4.7.1"},
+		{http.StatusServiceUnavailable, "451 4.3.0"},
+		{http.StatusBadRequest, "550 5.7.0"},
+	}
+	for _, tt := range tests {
+		fakeTokenEndpoint(t, 0)
+		fakeGraphEndpoint(t, tt.status, `{"error": {"code": "ErrorInternal", "message": "mailbox db-07 detail"}}`)
+		m := &tMessage{ID: newMessageID(), Username: "app@domain.com", Password: "good", MailFrom: "app@domain.com", RcptTo: []string{"a@example.com"}}
+		err := deliverMessage(context.Background(), m)
+		if tt.reply == "" {
+			if err != nil {
+				t.Errorf("status %d: expected delivery, got %v", tt.status, err)
+			}
+			continue
+		}
+		de, ok := err.(*deliveryError)
+		if !ok || !strings.HasPrefix(de.Reply, tt.reply) {
+			t.Errorf("status %d: expected reply %s, got %v", tt.status, tt.reply, err)
+			continue
+		}
+		if strings.Contains(de.Reply, "db-07") {
+			t.Errorf("status %d: expected the Graph error body to stay out of the reply, got '%s'", tt.status, de.Reply)
+		}
+	}
+}
+
+func TestDeliverMessage_InvalidCredentialsArePermanent(t *testing.T) {
+	fakeTokenEndpoint(t, 0)
+	fakeGraphEndpoint(t, http.StatusAccepted, "")
+	m := &tMessage{ID: newMessageID(), Username: "app@domain.com", Password: "wrong", MailFrom: "app@domain.com", RcptTo: []string{"a@example.com"}}
+	err := deliverMessage(context.Background(), m)
+	de, ok := err.(*deliveryError)
+	if !ok || de.temporary() || !strings.HasPrefix(de.Reply, "550 5.7.8") {
+		t.Errorf("expected a permanent 550 5.7.8 for invalid credentials, got %v", err)
+	}
+}
+
+func TestDeliverMessage_BccNotDisclosed(t *testing.T) {
+	fakeTokenEndpoint(t, 0)
+	graph := fakeGraphEndpoint(t, http.StatusAccepted, "")
+	m := &tMessage{ID: newMessageID(), Username: "app@domain.com", Password: "good", MailFrom: "app@domain.com",
+		RcptTo: []string{"a@example.com", "B@example.com", "hidden@example.com"}}
+	raw := "From: app@domain.com\nTo: a@example.com\nCc: b@example.com\nSubject: Hi\n\nBody\n"
+	if err := parseMessage(context.Background(), m, raw); err != nil {
+		t.Fatalf("parseMessage failed: %v", err)
+	}
+	if err := deliverMessage(context.Background(), m); err != nil {
+		t.Fatalf("deliverMessage failed: %v", err)
+	}
+	graph.mu.Lock()
+	defer graph.mu.Unlock()
+	msg, _ := graph.posted["message"].(map[string]any)
+	addresses := func(field string) []string {
+		var addrs []string
+		list, _ := msg[field].([]any)
+		for _, r := range list {
+			addrs = append(addrs, r.(map[string]any)["emailAddress"].(map[string]any)["address"].(string))
+		}
+		return addrs
+	}
+	if to, cc, bcc := addresses("toRecipients"), addresses("ccRecipients"), addresses("bccRecipients"); !reflect.DeepEqual(to, []string{"a@example.com"}) ||
+		!reflect.DeepEqual(cc, []string{"B@example.com"}) || !reflect.DeepEqual(bcc, []string{"hidden@example.com"}) {
+		t.Errorf("expected To a, Cc B and Bcc hidden, got To %v, Cc %v, Bcc %v", to, cc, bcc)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variables override config file values. The name is AZSMTP_ followed by the
+// YAML path in upper case, with a "_config" suffix dropped from section names, e.g.
+// oauth2_config.client_secret -> AZSMTP_OAUTH2_CLIENT_SECRET, rate_limits.per_ip.messages_per_day
+// -> AZSMTP_RATE_LIMITS_PER_IP_MESSAGES_PER_DAY. Lists of strings are comma separated, lists of
+// objects (listeners, api_keys, ...) and maps take a YAML/JSON value.
+const envPrefix = "AZSMTP_"
+
+// envConfigFile is the environment variable holding the config file path
+const envConfigFile = "AZSMTP_CONFIG"
+
+// applyEnvOverrides sets every config field that has a matching environment variable
+func applyEnvOverrides(c *tConfig) error {
+	return applyEnvStruct(reflect.ValueOf(c).Elem(), strings.TrimSuffix(envPrefix, "_"))
+}
+
+func applyEnvStruct(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if !f.IsExported() || tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(strings.TrimSuffix(tag, "_config"))
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvStruct(field, name); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setEnvValue(field, value); err != nil {
+			return fmt.Errorf("invalid value of %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// setEnvValue assigns an environment value to a config field
+func setEnvValue(field reflect.Value, value string) error {
+	switch {
+	case field.Kind() == reflect.String:
+		field.SetString(value) // verbatim: secrets may contain YAML special characters
+		return nil
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "["):
+		var list []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+		return nil
+	}
+	ptr := reflect.New(field.Type())
+	if err := yaml.Unmarshal([]byte(value), ptr.Interface()); err != nil {
+		return err
+	}
+	field.Set(ptr.Elem())
+	return nil
+}
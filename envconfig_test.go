@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	t.Setenv("AZSMTP_OAUTH2_CLIENT_SECRET", "s3cr:et #1")
+	t.Setenv("AZSMTP_OAUTH2_SCOPES", "a, b")
+	t.Setenv("AZSMTP_SAVE_TO_SENT", "true")
+	t.Setenv("AZSMTP_DRAIN_TIMEOUT", "45s")
+	t.Setenv("AZSMTP_RATE_LIMITS_PER_IP_MESSAGES_PER_DAY", "100")
+	t.Setenv("AZSMTP_PICKUP_IDENTITY_USERNAME", "app@domain.com")
+	t.Setenv("AZSMTP_LISTENERS", `[{addr: ":2525", protocol: lmtp}]`)
+
+	c := &tConfig{OAuth2Config: tOAuth2Config{ClientID: "from-file", ClientSecret: "from-file"}}
+	if err := applyEnvOverrides(c); err != nil {
+		t.Fatalf("applyEnvOverrides failed: %v", err)
+	}
+	if c.OAuth2Config.ClientID != "from-file" || c.OAuth2Config.ClientSecret != "s3cr:et #1" {
+		t.Errorf("unexpected oauth2 config %+v", c.OAuth2Config)
+	}
+	if !reflect.DeepEqual(c.OAuth2Config.Scopes, []string{"a", "b"}) {
+		t.Errorf("unexpected scopes %v", c.OAuth2Config.Scopes)
+	}
+	if !c.SaveToSent || c.DrainTimeout != 45*time.Second || c.RateLimits.PerIP.MessagesPerDay != 100 || c.Pickup.Identity.Username != "app@domain.com" {
+		t.Errorf("unexpected config %+v", c)
+	}
+	if len(c.Listeners) != 1 || c.Listeners[0].Addr != ":2525" || c.Listeners[0].Protocol != protocolLMTP {
+		t.Errorf("unexpected listeners %+v", c.Listeners)
+	}
+
+	t.Setenv("AZSMTP_MAX_SESSIONS", "many")
+	if err := applyEnvOverrides(&tConfig{}); err == nil {
+		t.Errorf("expected error for invalid AZSMTP_MAX_SESSIONS")
+	}
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	t.Setenv(envConfigFile, "")
+	if got := resolveConfigFile(""); got != defaultConfigFile() {
+		t.Errorf("expected default config file, got %s", got)
+	}
+	t.Setenv(envConfigFile, "/etc/azsmtp/env.yaml")
+	if got := resolveConfigFile(""); got != "/etc/azsmtp/env.yaml" {
+		t.Errorf("expected config file from environment, got %s", got)
+	}
+	if got := resolveConfigFile("/etc/azsmtp/flag.yaml"); got != "/etc/azsmtp/flag.yaml" {
+		t.Errorf("expected config file from flag, got %s", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if _, err := readConfigFile(path); err == nil {
+		t.Errorf("expected error for missing explicit config file")
+	}
+	os.WriteFile(path, []byte("log_level: debug\nadmin_addr: 127.0.0.1:2526\n"), 0600)
+	saved, savedFile := getConfig(), configFile
+	defer func() { setConfig(saved); configFile = savedFile }()
+	configFile = path
+	t.Setenv("AZSMTP_LOG_LEVEL", "warn")
+	if err := loadConfig(); err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if getConfig().LogLevel != "warn" || getConfig().AdminAddr != "127.0.0.1:2526" {
+		t.Errorf("expected environment to override the file, got %+v", getConfig())
+	}
+}
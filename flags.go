@@ -5,25 +5,86 @@ import (
 	"fmt"
 	"log"
 	"os"
+)
 
-	"gopkg.in/yaml.v3"
+var (
+	configFlag = flag.String("config", "", "Path of the config file (default: $"+envConfigFile+" or config.yaml next to the executable)")
+	checkCfg   = flag.Bool("check-config", false, "Validate the config file (strict YAML, addresses, TLS files, scopes, policies) and exit")
+	checkLive  = flag.Bool("live", false, "With -check-config: also acquire a token with the first configured identity")
+	encrypt    = flag.Bool("encrypt", false, "Encrypt sensitive configuration strings in the config file")
+	decrypt    = flag.Bool("decrypt", false, "Decrypt the encrypted configuration strings in the config file")
+	rotateKey  = flag.Bool("rotate-key", false, "Re-encrypt the config file with a new key file or $AZSMTP_SECRET_NEW_PASSPHRASE (not on Windows)")
+	lockouts   = flag.Bool("lockouts", false, "List active authentication lockouts of the running service (requires admin_addr)")
+	_          = flag.Bool("sendmail", false, "Run in sendmail-compatible mode: read a message from stdin (supports -t, -f, -i, -oi); also enabled when invoked as sendmail")
+	unlock     = flag.String("unlock", "", "Clear an authentication lockout of the running service, e.g. ip:10.0.0.1, user:app@domain.com or all (requires admin_addr)")
 )
 
+// flagsProcess runs the one-shot commands; flags are parsed in main before the config is loaded
 func flagsProcess() {
-	encrypt := flag.Bool("encrypt", false, "Encrypt sensitive configuration strings in the config file")
-
-	flag.Parse()
-
 	if *encrypt {
-		encryptConfigStrings()
-		marshaled, err := yaml.Marshal(config)
+		// Re-read the file so values from AZSMTP_* environment variables are not written into it
+		c, err := readConfigFile(configFile)
 		if err != nil {
-			log.Panic("Failed to marshal config:", err)
+			log.Fatal("Failed to read config file: ", err)
+		}
+		if err := decryptConfigStrings(c); err != nil {
+			log.Fatal("Failed to decrypt config: ", err)
 		}
-		if err := os.WriteFile(configFile, marshaled, 0644); err != nil {
-			log.Panic("Failed to write config file:", err)
+		if err := encryptConfigStrings(c); err != nil {
+			log.Fatal("Failed to encrypt config: ", err)
+		}
+		if err := writeConfigFile(configFile, c); err != nil {
+			log.Fatal("Failed to write config file: ", err)
 		}
 		fmt.Println("Configuration strings encrypted successfully.")
 		os.Exit(0)
 	}
+
+	if *decrypt {
+		c, err := readConfigFile(configFile)
+		if err != nil {
+			log.Fatal("Failed to read config file: ", err)
+		}
+		if err := decryptConfigStrings(c); err != nil {
+			log.Fatal("Failed to decrypt config: ", err)
+		}
+		if err := writeConfigFile(configFile, c); err != nil {
+			log.Fatal("Failed to write config file: ", err)
+		}
+		fmt.Println("Configuration strings decrypted successfully.")
+		os.Exit(0)
+	}
+
+	if *rotateKey {
+		if err := rotateSecretKey(configFile); err != nil {
+			log.Fatal("Failed to rotate key: ", err)
+		}
+		fmt.Println("Configuration strings re-encrypted with the new key.")
+		os.Exit(0)
+	}
+
+	if *lockouts {
+		lines, err := adminCommand(getConfig().AdminAddr, "LOCKOUTS")
+		if err != nil {
+			log.Fatal("Failed to list lockouts: ", err)
+		}
+		if len(lines) == 0 {
+			fmt.Println("No active lockouts.")
+		}
+		for _, l := range lines {
+			fmt.Println(l)
+		}
+		os.Exit(0)
+	}
+
+	if *unlock != "" {
+		lines, err := adminCommand(getConfig().AdminAddr, "UNLOCK "+*unlock)
+		if err != nil {
+			log.Fatal("Failed to clear lockout: ", err)
+		}
+		for _, l := range lines {
+			fmt.Println(l)
+		}
+		os.Exit(0)
+	}
 }
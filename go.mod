@@ -5,7 +5,6 @@ go 1.24.3
 require (
 	github.com/kardianos/service v1.2.2
 	github.com/pkg/errors v0.9.1
-	golang.org/x/oauth2 v0.30.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tHTTPAPIConfig holds the optional HTTP JSON submission API settings
+type tHTTPAPIConfig struct {
+	ListenAddr    string    `yaml:"listen_addr"`
+	TLSCert       string    `yaml:"tls_cert"`
+	TLSKey        string    `yaml:"tls_key"`
+	APIKeys       []tAPIKey `yaml:"api_keys"`
+	AllowUserAuth bool      `yaml:"allow_user_auth"` // HTTP Basic with the mailbox credentials, like SMTP AUTH
+	MaxBodyBytes  int64     `yaml:"max_body_bytes"`
+}
+
+// tAPIKey maps an API key to the identity the messages are sent as
+type tAPIKey struct {
+	Name     string    `yaml:"name"`
+	Key      string    `yaml:"key"`
+	Identity tIdentity `yaml:"identity"`
+}
+
+type apiAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     string `json:"content"` // base64
+}
+
+type apiMessageRequest struct {
+	From        string          `json:"from"`
+	To          []string        `json:"to"`
+	Cc          []string        `json:"cc"`
+	Bcc         []string        `json:"bcc"`
+	Subject     string          `json:"subject"`
+	Text        string          `json:"text"`
+	HTML        string          `json:"html"`
+	Attachments []apiAttachment `json:"attachments"`
+}
+
+type apiMessageResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // sent, rejected, deferred, failed
+	Error  string `json:"error,omitempty"`
+}
+
+// newAPIHandler returns the handler serving POST /api/v1/messages; settings are read per request
+func newAPIHandler(settings func() tHTTPAPIConfig) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		handleAPIMessage(settings(), w, r)
+	})
+	return mux
+}
+
+// newAPIServer returns the HTTP server for the submission API, following config reloads
+func newAPIServer() *http.Server {
+	return &http.Server{
+		Handler:           newAPIHandler(func() tHTTPAPIConfig { return getConfig().HTTPAPI }),
+		ReadHeaderTimeout: 30 * time.Second,
+		ReadTimeout:       durationOrDefault(getConfig().Timeouts.Data, defaultDataTimeout),
+	}
+}
+
+func handleAPIMessage(c tHTTPAPIConfig, w http.ResponseWriter, r *http.Request) {
+	m := &tMessage{ID: newMessageID(), Source: "http", ClientIP: remoteIPString(r.RemoteAddr)}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAPIResponse(w, http.StatusMethodNotAllowed, apiMessageResponse{ID: m.ID, Status: "rejected", Error: "method not allowed"})
+		return
+	}
+	ident, status, err := apiAuthenticate(c, r, m.ClientIP)
+	if err != nil {
+		if status == http.StatusUnauthorized && c.AllowUserAuth {
+			w.Header().Set("WWW-Authenticate", `Basic realm="azureSMTPwithOAuth"`)
+		}
+		writeAPIResponse(w, status, apiMessageResponse{ID: m.ID, Status: "rejected", Error: err.Error()})
+		return
+	}
+	m.Username, m.Password = ident.Username, ident.Password
+	m.forgetPassword()
+
+	maxSize := maxMessageSize(getConfig())
+	maxBytes := c.MaxBodyBytes
+	if maxBytes <= 0 { // room for max_message_size in base64 plus the JSON around it
+		maxBytes = int64(base64.StdEncoding.EncodedLen(int(maxSize))) + 64<<10
+	}
+	var req apiMessageRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeAPIResponse(w, http.StatusRequestEntityTooLarge, apiMessageResponse{ID: m.ID, Status: "rejected", Error: "request body too large"})
+			return
+		}
+		writeAPIResponse(w, http.StatusBadRequest, apiMessageResponse{ID: m.ID, Status: "rejected", Error: "invalid JSON: " + err.Error()})
+		return
+	}
+	if err := apiBuildMessage(m, req); err != nil {
+		writeAPIResponse(w, http.StatusBadRequest, apiMessageResponse{ID: m.ID, Status: "rejected", Error: err.Error()})
+		return
+	}
+	if messageSize(m) > maxSize {
+		writeAPIResponse(w, http.StatusRequestEntityTooLarge, apiMessageResponse{ID: m.ID, Status: "rejected", Error: "message exceeds max_message_size"})
+		return
+	}
+	if err := checkMessagePolicy(m); err != nil {
+		apiDeliveryFailed(w, m, err)
+		return
+	}
+	if err := deliverMessage(r.Context(), m); err != nil {
+		apiDeliveryFailed(w, m, err)
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, apiMessageResponse{ID: m.ID, Status: "sent"})
+}
+
+// apiAuthenticate resolves the identity from an API key (Bearer or X-API-Key) or HTTP Basic credentials
+func apiAuthenticate(c tHTTPAPIConfig, r *http.Request, ip string) (tIdentity, int, error) {
+	if _, until, locked := authGuard.locked(ip, ""); locked {
+		return tIdentity{}, http.StatusTooManyRequests, fmt.Errorf("too many failed authentication attempts, locked until %s", until.Format(time.RFC3339))
+	}
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); key == "" && strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimSpace(auth[len("Bearer "):])
+	}
+	if key != "" {
+		for _, k := range c.APIKeys {
+			if k.Key != "" && subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+				logger.Debug("API key authenticated", "name", k.Name, "username", k.Identity.Username)
+				return k.Identity, 0, nil
+			}
+		}
+		authGuard.fail(getConfig().AuthGuard, ip, "")
+		return tIdentity{}, http.StatusUnauthorized, errors.New("invalid API key")
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok || !c.AllowUserAuth {
+		return tIdentity{}, http.StatusUnauthorized, errors.New("authentication required")
+	}
+	if _, until, locked := authGuard.locked(ip, username); locked {
+		return tIdentity{}, http.StatusTooManyRequests, fmt.Errorf("too many failed authentication attempts, locked until %s", until.Format(time.RFC3339))
+	}
+	if _, err := getCachedOAuth2Token(r.Context(), "", username, password); err != nil {
+		switch classifyAuthError(err) {
+		case authErrCredentials:
+			logger.Warn("Authentication failed: invalid credentials", "username", username, "ip", ip, "error", err)
+			time.Sleep(authGuard.fail(getConfig().AuthGuard, ip, username))
+			return tIdentity{}, http.StatusUnauthorized, errors.New("authentication credentials invalid")
+		case authErrMFA:
+			logger.Warn("Authentication failed: MFA or Conditional Access required", "username", username, "ip", ip, "error", err)
+			return tIdentity{}, http.StatusForbidden, errors.New("MFA or Conditional Access required")
+		}
+		logger.Error("Authentication failed: token endpoint unavailable", "username", username, "ip", ip, "error", err)
+		return tIdentity{}, http.StatusServiceUnavailable, errors.New("temporary authentication failure")
+	}
+	authGuard.success(username)
+	return tIdentity{Username: username, Password: password}, 0, nil
+}
+
+// apiBuildMessage validates the request and fills in the message
+func apiBuildMessage(m *tMessage, req apiMessageRequest) error {
+	m.MailFrom = req.From
+	if m.MailFrom == "" {
+		m.MailFrom = m.Username
+	}
+	for _, list := range []struct {
+		addrs []string
+		dst   *[]string
+	}{{req.To, &m.To}, {req.Cc, &m.Cc}, {req.Bcc, &m.Bcc}} {
+		for _, addr := range list.addrs {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				*list.dst = append(*list.dst, addr)
+				m.RcptTo = append(m.RcptTo, addr)
+			}
+		}
+	}
+	m.Subject = req.Subject
+	m.Body = req.Text
+	if req.HTML != "" {
+		m.Body = req.HTML
+		m.IsHTML = true
+	}
+	for _, a := range req.Attachments {
+		if a.Filename == "" {
+			return errors.New("attachment without filename")
+		}
+		if _, err := base64.StdEncoding.DecodeString(a.Content); err != nil || a.Content == "" {
+			return fmt.Errorf("attachment %s: content must be non-empty base64", a.Filename)
+		}
+		ctype := a.ContentType
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		m.Attachments = append(m.Attachments, Attachment{Filename: a.Filename, ContentType: ctype, Content: a.Content})
+	}
+	return nil
+}
+
+// apiDeliveryFailed maps a delivery error to an HTTP response
+func apiDeliveryFailed(w http.ResponseWriter, m *tMessage, err error) {
+	var de *deliveryError
+	if !errors.As(err, &de) {
+		writeAPIResponse(w, http.StatusInternalServerError, apiMessageResponse{ID: m.ID, Status: "failed", Error: err.Error()})
+		return
+	}
+	status, state := http.StatusBadGateway, "failed"
+	switch {
+	case strings.HasPrefix(de.Reply, "452 4.5.3"):
+		status, state = http.StatusBadRequest, "rejected"
+	case strings.HasPrefix(de.Reply, "451 4.7.1"):
+		status, state = http.StatusTooManyRequests, "deferred"
+	case de.temporary():
+		status, state = http.StatusServiceUnavailable, "deferred"
+	case strings.HasPrefix(de.Reply, "550 5.7.1"):
+		status, state = http.StatusForbidden, "rejected"
+	case strings.HasPrefix(de.Reply, "503"), strings.HasPrefix(de.Reply, "550 5.6.0"):
+		status, state = http.StatusBadRequest, "rejected"
+	}
+	writeAPIResponse(w, status, apiMessageResponse{ID: m.ID, Status: state, Error: de.Reply})
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, resp apiMessageResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// remoteIPString returns the IP part of a host:port address
+func remoteIPString(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func apiRequest(t *testing.T, c tHTTPAPIConfig, apiKey, body string) (*httptest.ResponseRecorder, apiMessageResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/messages", strings.NewReader(body))
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	rec := httptest.NewRecorder()
+	newAPIHandler(func() tHTTPAPIConfig { return c }).ServeHTTP(rec, req)
+	var resp apiMessageResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON response '%s': %v", rec.Body.String(), err)
+	}
+	return rec, resp
+}
+
+func TestHTTPAPI_Authentication(t *testing.T) {
+	setConfig(&tConfig{})
+	authGuard = newAuthGuard()
+	c := tHTTPAPIConfig{APIKeys: []tAPIKey{{Name: "app", Key: "k1", Identity: tIdentity{Username: "app@domain.com"}}}}
+	if rec, resp := apiRequest(t, c, "", `{}`); rec.Code != http.StatusUnauthorized || resp.Status != "rejected" || resp.ID == "" {
+		t.Errorf("expected 401 rejected with ID without credentials, got %d %+v", rec.Code, resp)
+	}
+	if rec, _ := apiRequest(t, c, "wrong", `{}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for invalid API key, got %d", rec.Code)
+	}
+}
+
+func TestHTTPAPI_Validation(t *testing.T) {
+	setConfig(&tConfig{})
+	authGuard = newAuthGuard()
+	c := tHTTPAPIConfig{APIKeys: []tAPIKey{{Name: "app", Key: "k1", Identity: tIdentity{Username: "app@domain.com"}}}}
+	if rec, _ := apiRequest(t, c, "k1", `{"to": "not-a-list"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid JSON, got %d", rec.Code)
+	}
+	if rec, _ := apiRequest(t, c, "k1", `{"to": ["a@example.com"], "attachments": [{"filename": "a.txt", "content": "%%%"}]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid attachment, got %d", rec.Code)
+	}
+	if rec, resp := apiRequest(t, c, "k1", `{"subject": "no recipients"}`); rec.Code != http.StatusBadRequest || !strings.HasPrefix(resp.Error, "503") {
+		t.Errorf("expected 400 without recipients, got %d %+v", rec.Code, resp)
+	}
+}
+
+func TestHTTPAPI_RecipientPolicy(t *testing.T) {
+	setConfig(&tConfig{RecipientPolicy: tRecipientPolicy{BlockedDomains: []string{"spam.com"}}})
+	authGuard = newAuthGuard()
+	c := tHTTPAPIConfig{APIKeys: []tAPIKey{{Name: "app", Key: "k1", Identity: tIdentity{Username: "app@domain.com"}}}}
+	rec, resp := apiRequest(t, c, "k1", `{"to": ["you@spam.com"], "subject": "hi", "text": "hello"}`)
+	if rec.Code != http.StatusForbidden || resp.Status != "rejected" || !strings.HasPrefix(resp.Error, "550 5.7.1") {
+		t.Errorf("expected 403 rejected by policy, got %d %+v", rec.Code, resp)
+	}
+}
+
+func TestHTTPAPI_MaxMessageSize(t *testing.T) {
+	setConfig(&tConfig{MaxMessageSize: 1000})
+	authGuard = newAuthGuard()
+	c := tHTTPAPIConfig{APIKeys: []tAPIKey{{Name: "app", Key: "k1", Identity: tIdentity{Username: "app@domain.com"}}}}
+	body := `{"to": ["a@example.com"], "text": "` + strings.Repeat("x", 1200) + `"}`
+	if rec, resp := apiRequest(t, c, "k1", body); rec.Code != http.StatusRequestEntityTooLarge || resp.Status != "rejected" {
+		t.Errorf("expected 413 for a message over max_message_size, got %d %+v", rec.Code, resp)
+	}
+	c.MaxBodyBytes = 100
+	if rec, _ := apiRequest(t, c, "k1", body); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a body over max_body_bytes, got %d", rec.Code)
+	}
+}
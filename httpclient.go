@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// tHTTPClientConfig tunes the HTTP client shared by the token endpoint and Graph calls
+type tHTTPClientConfig struct {
+	Timeout               time.Duration `yaml:"timeout"`                 // whole request including the body, large attachments need time
+	DialTimeout           time.Duration `yaml:"dial_timeout"`            // TCP connect
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout"`   // TLS handshake
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"` // from the end of the request body to the response headers
+	IdleConnTimeout       time.Duration `yaml:"idle_conn_timeout"`       // keep-alive connections are closed after this
+	MaxIdleConnsPerHost   int           `yaml:"max_idle_conns_per_host"`
+	DisableHTTP2          bool          `yaml:"disable_http2"`
+	ProxyURL              string        `yaml:"proxy_url"` // empty uses HTTPS_PROXY/HTTP_PROXY/NO_PROXY, "direct" none
+	CABundle              string        `yaml:"ca_bundle"` // PEM file trusted in addition to the system roots, e.g. of a TLS-inspecting proxy
+}
+
+const (
+	defaultHTTPTimeout               = 5 * time.Minute
+	defaultHTTPDialTimeout           = 10 * time.Second
+	defaultHTTPTLSHandshakeTimeout   = 10 * time.Second
+	defaultHTTPResponseHeaderTimeout = 2 * time.Minute
+	defaultHTTPIdleConnTimeout       = 90 * time.Second
+	defaultHTTPMaxIdleConnsPerHost   = 10
+)
+
+// httpClientPtr holds the shared client; a reload with changed http_client settings swaps it
+var httpClientPtr atomic.Pointer[http.Client]
+
+// httpClient returns the shared client for the token endpoint and Graph, built from the config on first use
+func httpClient() *http.Client {
+	if client := httpClientPtr.Load(); client != nil {
+		return client
+	}
+	var hc tHTTPClientConfig
+	if c := getConfig(); c != nil {
+		hc = c.HTTPClient
+	}
+	client, err := newHTTPClient(hc)
+	if err != nil {
+		logger.Error("Invalid http_client settings, using the defaults", "error", err)
+		client, _ = newHTTPClient(tHTTPClientConfig{})
+	}
+	if httpClientPtr.CompareAndSwap(nil, client) {
+		return client
+	}
+	return httpClientPtr.Load()
+}
+
+// setHTTPClient replaces the shared client; connections of the old one are closed once idle
+func setHTTPClient(hc tHTTPClientConfig) error {
+	client, err := newHTTPClient(hc)
+	if err != nil {
+		return err
+	}
+	if old := httpClientPtr.Swap(client); old != nil {
+		old.CloseIdleConnections()
+	}
+	return nil
+}
+
+func newHTTPClient(hc tHTTPClientConfig) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	switch hc.ProxyURL {
+	case "":
+	case "direct":
+		proxy = nil
+	default:
+		u, err := parseProxyURL(hc.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if hc.CABundle != "" {
+		pool, err := loadCABundle(hc.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	maxIdle := hc.MaxIdleConnsPerHost
+	if maxIdle <= 0 {
+		maxIdle = defaultHTTPMaxIdleConnsPerHost
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           (&net.Dialer{Timeout: durationOrDefault(hc.DialTimeout, defaultHTTPDialTimeout), KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   durationOrDefault(hc.TLSHandshakeTimeout, defaultHTTPTLSHandshakeTimeout),
+		ResponseHeaderTimeout: durationOrDefault(hc.ResponseHeaderTimeout, defaultHTTPResponseHeaderTimeout),
+		IdleConnTimeout:       durationOrDefault(hc.IdleConnTimeout, defaultHTTPIdleConnTimeout),
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdle,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     !hc.DisableHTTP2, // a custom dialer and TLS config disable HTTP/2 otherwise
+	}
+	if hc.DisableHTTP2 {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{Transport: transport, Timeout: durationOrDefault(hc.Timeout, defaultHTTPTimeout)}, nil
+}
+
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy_url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy_url %q, expected http://, https:// or socks5://", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy_url %q, no host", s)
+	}
+	return u, nil
+}
+
+// loadCABundle returns the system roots plus the certificates of a PEM file
+func loadCABundle(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ca_bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("ca_bundle %s holds no PEM certificates", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewHTTPClient_CABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+
+	client, err := newHTTPClient(tHTTPClientConfig{ProxyURL: "direct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(srv.URL); err == nil {
+		t.Errorf("expected an untrusted certificate to fail")
+	}
+	client, err = newHTTPClient(tHTTPClientConfig{ProxyURL: "direct", CABundle: bundle})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("expected the CA bundle to be trusted: %v", err)
+	}
+	resp.Body.Close()
+
+	if _, err := newHTTPClient(tHTTPClientConfig{CABundle: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Errorf("expected a missing CA bundle to fail")
+	}
+}
+
+func TestNewHTTPClient_Proxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+	client, err := newHTTPClient(tHTTPClientConfig{ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("http://graph.example.invalid/v1.0/users")
+	if err != nil {
+		t.Fatalf("request through proxy failed: %v", err)
+	}
+	resp.Body.Close()
+	if proxied != "http://graph.example.invalid/v1.0/users" {
+		t.Errorf("expected the request to go through the proxy, got %q", proxied)
+	}
+	for _, bad := range []string{"ftp://proxy:21", "http://", "://x"} {
+		if _, err := newHTTPClient(tHTTPClientConfig{ProxyURL: bad}); err == nil {
+			t.Errorf("expected proxy_url %q to be rejected", bad)
+		}
+	}
+}
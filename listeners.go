@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TLS modes of a listener
+const (
+	tlsModeNone     = "none"
+	tlsModeStartTLS = "starttls"
+	tlsModeImplicit = "implicit"
+)
+
+// Protocols of a listener
+const (
+	protocolSMTP = "smtp"
+	protocolLMTP = "lmtp"
+)
+
+// tListenerConfig holds the definition and policy of one SMTP listener
+type tListenerConfig struct {
+	Addr            string    `yaml:"addr"`
+	Protocol        string    `yaml:"protocol"` // smtp (default) or lmtp
+	TLS             string    `yaml:"tls"`      // none, starttls, implicit
+	TLSCert         string    `yaml:"tls_cert"`
+	TLSKey          string    `yaml:"tls_key"`
+	RequireAuth     bool      `yaml:"require_auth"`
+	AuthMechanisms  []string  `yaml:"auth_mechanisms"` // LOGIN, PLAIN (default LOGIN)
+	AllowedIPs      []string  `yaml:"allowed_ips"`     // IPs or CIDRs, empty allows everybody
+	DefaultIdentity tIdentity `yaml:"default_identity"`
+	Tenant          string    `yaml:"tenant"` // tenant profile for all users of this listener
+	// Unix socket listeners (addr: unix:/path/to/socket)
+	SocketMode     string               `yaml:"socket_mode"`     // octal file mode, e.g. "0660"
+	SocketOwner    string               `yaml:"socket_owner"`    // user or user:group
+	PeerIdentities map[string]tIdentity `yaml:"peer_identities"` // local uid or user name -> identity (SO_PEERCRED, Linux)
+	// HAProxy PROXY protocol v1/v2, only accepted from trusted_proxies
+	ProxyProtocol    bool     `yaml:"proxy_protocol"`
+	TrustedProxies   []string `yaml:"trusted_proxies"`
+	ProxyAllowDirect bool     `yaml:"proxy_allow_direct"` // serve peers outside trusted_proxies with their own address
+}
+
+// tIdentity is a mailbox and password used to get a token on behalf of the client
+type tIdentity struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// tListener is a configured listener ready to serve sessions
+type tListener struct {
+	tListenerConfig
+	tlsConfig *tls.Config
+	allowed   []*net.IPNet
+	proxies   []*net.IPNet
+}
+
+// listenerConfigs returns the configured listeners; the legacy listen_addr becomes a plaintext listener
+func listenerConfigs(c *tConfig) []tListenerConfig {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	return []tListenerConfig{{Addr: c.ListenAddr, TLS: tlsModeNone}}
+}
+
+// newListener validates a listener definition and loads its certificate
+func newListener(lc tListenerConfig) (*tListener, error) {
+	l := &tListener{tListenerConfig: lc}
+	l.TLS = strings.ToLower(l.TLS)
+	if l.TLS == "" {
+		l.TLS = tlsModeNone
+	}
+	switch l.TLS {
+	case tlsModeNone:
+	case tlsModeStartTLS, tlsModeImplicit:
+		cert, err := tls.LoadX509KeyPair(l.TLSCert, l.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: failed to load TLS certificate: %w", l.Addr, err)
+		}
+		l.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	default:
+		return nil, fmt.Errorf("listener %s: unknown tls mode %q", l.Addr, lc.TLS)
+	}
+	l.Protocol = strings.ToLower(l.Protocol)
+	if l.Protocol == "" {
+		l.Protocol = protocolSMTP
+	}
+	if l.Protocol != protocolSMTP && l.Protocol != protocolLMTP {
+		return nil, fmt.Errorf("listener %s: unknown protocol %q", l.Addr, lc.Protocol)
+	}
+	if len(l.AuthMechanisms) == 0 {
+		l.AuthMechanisms = []string{"LOGIN"}
+	}
+	for i, m := range l.AuthMechanisms {
+		l.AuthMechanisms[i] = strings.ToUpper(m)
+		if l.AuthMechanisms[i] != "LOGIN" && l.AuthMechanisms[i] != "PLAIN" {
+			return nil, fmt.Errorf("listener %s: unsupported auth mechanism %q", l.Addr, m)
+		}
+	}
+	nets, err := parseIPNets(l.AllowedIPs)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %w", l.Addr, err)
+	}
+	l.allowed = nets
+	if l.proxies, err = parseIPNets(l.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("listener %s: %w", l.Addr, err)
+	}
+	if l.ProxyProtocol && len(l.proxies) == 0 {
+		return nil, fmt.Errorf("listener %s: proxy_protocol requires trusted_proxies", l.Addr)
+	}
+	if l.ProxyProtocol && len(l.PeerIdentities) > 0 { // the peer credentials would be the proxy's
+		return nil, fmt.Errorf("listener %s: peer_identities can't be used with proxy_protocol", l.Addr)
+	}
+	return l, nil
+}
+
+// socketPath returns the path of a unix:/path listener, or "" for TCP listeners
+func (l *tListener) socketPath() string {
+	if strings.HasPrefix(l.Addr, "unix:") {
+		return l.Addr[len("unix:"):]
+	}
+	return ""
+}
+
+// listen binds the listener's socket
+func (l *tListener) listen() (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if path := l.socketPath(); path != "" {
+		ln, err = listenUnix(path, l.SocketMode, l.SocketOwner)
+	} else {
+		ln, err = net.Listen("tcp", l.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Implicit TLS is started per connection in serveConn, after the PROXY header
+	return ln, nil
+}
+
+// listenUnix creates a Unix domain socket, replacing a stale socket file, and applies mode and owner
+func listenUnix(path, mode, owner string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		// Only a socket nobody answers on is stale, never take over one that is in use
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("socket %s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("invalid socket_mode %q", mode)
+		}
+		if err := os.Chmod(path, os.FileMode(m)); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if owner != "" {
+		uid, gid, err := lookupOwner(owner)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// lookupOwner resolves "user" or "user:group" (names or numeric ids); -1 leaves the id unchanged
+func lookupOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	name, group, _ := strings.Cut(owner, ":")
+	if name != "" {
+		if uid, err = strconv.Atoi(name); err != nil {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid socket_owner %q: %w", owner, err)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid socket_owner %q: %w", owner, err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+// peerIdentity maps the local peer of a Unix socket connection to an identity via its uid
+func (l *tListener) peerIdentity(conn net.Conn) (tIdentity, bool) {
+	if len(l.PeerIdentities) == 0 || l.socketPath() == "" {
+		return tIdentity{}, false
+	}
+	if tc, ok := conn.(*tls.Conn); ok { // the credentials are on the socket under TLS
+		conn = tc.NetConn()
+	}
+	uid, pid, err := peerCredentials(conn)
+	if err != nil {
+		logger.Warn("Failed to read peer credentials", "listener", l.Addr, "error", err)
+		return tIdentity{}, false
+	}
+	key := strconv.Itoa(uid)
+	ident, ok := l.PeerIdentities[key]
+	if !ok {
+		if u, err := user.LookupId(key); err == nil {
+			ident, ok = l.PeerIdentities[u.Username]
+		}
+	}
+	if ok {
+		logger.Debug("Peer credentials mapped to identity", "uid", uid, "pid", pid, "username", ident.Username)
+	}
+	return ident, ok
+}
+
+// allowsMechanism reports whether the AUTH mechanism is enabled on this listener
+func (l *tListener) allowsMechanism(m string) bool {
+	for _, a := range l.AuthMechanisms {
+		if strings.EqualFold(a, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsIP reports whether the client IP passes the listener's ACL
+func (l *tListener) allowsIP(ip string) bool {
+	return len(l.allowed) == 0 || ipInNets(ip, l.allowed)
+}
+
+// parseIPNets parses a list of IPs and CIDRs
+func parseIPNets(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// serveConn applies the connection-level policy and runs the SMTP session
+func serveConn(conn net.Conn, l *tListener) {
+	if l.ProxyProtocol {
+		pc, err := acceptProxyHeader(conn, l.proxies, l.ProxyAllowDirect)
+		if errors.Is(err, errUntrustedProxy) {
+			logger.Warn("Connection rejected: not from a trusted proxy", "ip", remoteIP(conn.RemoteAddr()), "listener", l.Addr)
+			conn.Close()
+			return
+		}
+		if err != nil {
+			logger.Warn("Invalid PROXY protocol header", "proxy", remoteIP(conn.RemoteAddr()), "listener", l.Addr, "error", err)
+			conn.Close()
+			return
+		}
+		conn = pc
+	}
+	// The policy is checked on the raw connection, a refused client never gets a TLS handshake
+	ip := remoteIP(conn.RemoteAddr())
+	reject := func(reply string) {
+		if l.TLS != tlsModeImplicit { // an implicit TLS client can't read a plaintext reply
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			fmt.Fprintf(conn, "%s\r\n", reply)
+		}
+		conn.Close()
+	}
+	if draining.Load() {
+		reject("421 4.3.2 Service shutting down")
+		return
+	}
+	if l.socketPath() == "" && !l.allowsIP(ip) {
+		logger.Warn("Connection rejected by listener ACL", "ip", ip, "listener", l.Addr)
+		reject("554 5.7.1 Access denied")
+		return
+	}
+	c := getConfig()
+	if !sessionLimiter.acquire(ip, c.MaxSessions, c.MaxSessionsPerIP) {
+		logger.Warn("Connection rejected: too many sessions", "ip", ip)
+		reject("421 4.7.0 Too many connections, try again later")
+		return
+	}
+	defer sessionLimiter.release(ip)
+	if l.TLS == tlsModeImplicit {
+		tlsConn := tls.Server(conn, l.tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(durationOrDefault(c.Timeouts.Command, defaultCommandTimeout)))
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Warn("TLS handshake failed", "ip", ip, "error", err)
+			tlsConn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	handleSMTPConnection(conn, l)
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testListener(t *testing.T, lc tListenerConfig) *tListener {
+	t.Helper()
+	l, err := newListener(lc)
+	if err != nil {
+		t.Fatalf("newListener failed: %v", err)
+	}
+	return l
+}
+
+// testCertificate writes a self-signed certificate and key into a temporary directory
+func testCertificate(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+// smtpExchange sends a command and returns the last line of the reply
+func smtpExchange(t *testing.T, rw *bufio.ReadWriter, cmd string) string {
+	t.Helper()
+	if cmd != "" {
+		rw.WriteString(cmd + "\r\n")
+		rw.Flush()
+	}
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read reply to '%s': %v", cmd, err)
+		}
+		if len(line) < 4 || line[3] != '-' {
+			return strings.TrimRight(line, "\r\n")
+		}
+	}
+}
+
+func TestListenerAllowsIP(t *testing.T) {
+	l := testListener(t, tListenerConfig{AllowedIPs: []string{"10.0.0.0/8", "192.168.1.5", "::1"}})
+	for ip, want := range map[string]bool{"10.1.2.3": true, "192.168.1.5": true, "192.168.1.6": false, "::1": true, "": false} {
+		if got := l.allowsIP(ip); got != want {
+			t.Errorf("allowsIP(%q): expected %v, got %v", ip, want, got)
+		}
+	}
+	if _, err := newListener(tListenerConfig{AllowedIPs: []string{"not-an-ip"}}); err == nil {
+		t.Errorf("expected invalid ACL entry to be rejected")
+	}
+}
+
+func TestDecodePlainAuth(t *testing.T) {
+	user, pass := decodePlainAuth(base64.StdEncoding.EncodeToString([]byte("\x00app@domain.com\x00secret")))
+	if user != "app@domain.com" || pass != "secret" {
+		t.Errorf("expected app@domain.com/secret, got '%s'/'%s'", user, pass)
+	}
+	if user, _ := decodePlainAuth("invalid"); user != "" {
+		t.Errorf("expected empty username for invalid response, got '%s'", user)
+	}
+}
+
+func TestHandleSMTPConnection_StartTLSRequiredForAuth(t *testing.T) {
+	setConfig(&tConfig{})
+	certFile, keyFile := testCertificate(t)
+	l := testListener(t, tListenerConfig{TLS: tlsModeStartTLS, TLSCert: certFile, TLSKey: keyFile, RequireAuth: true, AuthMechanisms: []string{"plain", "login"}})
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleSMTPConnection(server, l)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	rw := bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
+	smtpExchange(t, rw, "")
+	if reply := smtpExchange(t, rw, "EHLO test"); reply != "250 STARTTLS" {
+		t.Errorf("expected STARTTLS to be advertised before TLS, got '%s'", reply)
+	}
+	if reply := smtpExchange(t, rw, "AUTH PLAIN"); !strings.HasPrefix(reply, "538") {
+		t.Errorf("expected 538 for AUTH before STARTTLS, got '%s'", reply)
+	}
+	if reply := smtpExchange(t, rw, "STARTTLS"); !strings.HasPrefix(reply, "220") {
+		t.Fatalf("expected 220 for STARTTLS, got '%s'", reply)
+	}
+	tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	rw = bufio.NewReadWriter(bufio.NewReader(tlsClient), bufio.NewWriter(tlsClient))
+	if reply := smtpExchange(t, rw, "EHLO test"); reply != "250 AUTH PLAIN LOGIN" {
+		t.Errorf("expected AUTH to be advertised after TLS, got '%s'", reply)
+	}
+	if reply := smtpExchange(t, rw, "MAIL FROM:<app@domain.com>"); !strings.HasPrefix(reply, "530") {
+		t.Errorf("expected 530 without AUTH, got '%s'", reply)
+	}
+}
+
+func TestHandleSMTPConnection_DefaultIdentity(t *testing.T) {
+	setConfig(&tConfig{})
+	l := testListener(t, tListenerConfig{DefaultIdentity: tIdentity{Username: "app@domain.com", Password: "secret"}})
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleSMTPConnection(server, l)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	rw := bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
+	smtpExchange(t, rw, "")
+	if reply := smtpExchange(t, rw, "MAIL FROM:<app@domain.com>"); !strings.HasPrefix(reply, "250") {
+		t.Errorf("expected MAIL FROM to be accepted with default identity, got '%s'", reply)
+	}
+	if reply := smtpExchange(t, rw, "AUTH CRAM-MD5"); !strings.HasPrefix(reply, "504") {
+		t.Errorf("expected 504 for disabled mechanism, got '%s'", reply)
+	}
+}
+
+func TestHandleSMTPConnection_RequireAuthIgnoresFallback(t *testing.T) {
+	requests := fakeTokenEndpoint(t, 0)
+	setConfig(&tConfig{FallbackSMTPuser: "app@domain.com", FallbackSMTPpass: "good"})
+	l := testListener(t, tListenerConfig{RequireAuth: true, AuthMechanisms: []string{"plain"}})
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleSMTPConnection(server, l)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	rw := bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
+	smtpExchange(t, rw, "")
+	empty := base64.StdEncoding.EncodeToString([]byte("\x00\x00"))
+	if reply := smtpExchange(t, rw, "AUTH PLAIN "+empty); !strings.HasPrefix(reply, "535") {
+		t.Errorf("expected 535 for empty credentials on a require_auth listener, got '%s'", reply)
+	}
+	if reply := smtpExchange(t, rw, "MAIL FROM:<app@domain.com>"); !strings.HasPrefix(reply, "530") {
+		t.Errorf("expected 530 without AUTH, got '%s'", reply)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("expected no token request for the fallback credentials, got %d", n)
+	}
+}
+
+func TestUnixListener_PeerIdentity(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	setConfig(&tConfig{})
+	path := filepath.Join(t.TempDir(), "smtp.sock")
+	l := testListener(t, tListenerConfig{
+		Addr:           "unix:" + path,
+		SocketMode:     "0600",
+		RequireAuth:    true,
+		PeerIdentities: map[string]tIdentity{strconv.Itoa(os.Getuid()): {Username: "app@domain.com", Password: "secret"}},
+	})
+	ln, err := l.listen()
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("expected socket with mode 0600, got %v (%v)", fi.Mode().Perm(), err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			handleSMTPConnection(conn, l)
+		}
+	}()
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	rw := bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
+	smtpExchange(t, rw, "")
+	if reply := smtpExchange(t, rw, "MAIL FROM:<app@domain.com>"); !strings.HasPrefix(reply, "250") {
+		t.Errorf("expected MAIL FROM to be accepted for mapped peer, got '%s'", reply)
+	}
+}
+
+func TestUnixListener_PeerIdentityOverTLS(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	setConfig(&tConfig{})
+	certFile, keyFile := testCertificate(t)
+	path := filepath.Join(t.TempDir(), "smtp.sock")
+	l := testListener(t, tListenerConfig{
+		Addr:           "unix:" + path,
+		TLS:            tlsModeImplicit,
+		TLSCert:        certFile,
+		TLSKey:         keyFile,
+		RequireAuth:    true,
+		PeerIdentities: map[string]tIdentity{strconv.Itoa(os.Getuid()): {Username: "app@domain.com", Password: "secret"}},
+	})
+	ln, err := l.listen()
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			serveConn(conn, l)
+		}
+	}()
+	client, err := tls.Dial("unix", path, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	rw := bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
+	smtpExchange(t, rw, "")
+	if reply := smtpExchange(t, rw, "MAIL FROM:<app@domain.com>"); !strings.HasPrefix(reply, "250") {
+		t.Errorf("expected MAIL FROM to be accepted for mapped peer over TLS, got '%s'", reply)
+	}
+}
+
+func TestListenUnix_ReplacesOnlyStaleSockets(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(file, "", ""); err == nil {
+		t.Errorf("expected an error for a path that is not a socket")
+	}
+	path := filepath.Join(dir, "smtp.sock")
+	live, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	if _, err := listenUnix(path, "", ""); err == nil {
+		t.Errorf("expected an error for a socket in use")
+	}
+	// A crashed process leaves its socket file behind
+	live.(*net.UnixListener).SetUnlinkOnClose(false)
+	live.Close()
+	ln, err := listenUnix(path, "", "")
+	if err != nil {
+		t.Fatalf("expected a stale socket to be replaced, got %v", err)
+	}
+	ln.Close()
+}
+
+func TestHandleSMTPConnection_LMTPPerRecipientReplies(t *testing.T) {
+	setConfig(&tConfig{})
+	l := testListener(t, tListenerConfig{Protocol: "LMTP", DefaultIdentity: tIdentity{Username: "app@domain.com", Password: "secret"}})
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleSMTPConnection(server, l)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	rw := bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
+	if greeting := smtpExchange(t, rw, ""); !strings.HasPrefix(greeting, "220 LMTP") {
+		t.Errorf("expected LMTP greeting, got '%s'", greeting)
+	}
+	if reply := smtpExchange(t, rw, "EHLO test"); !strings.HasPrefix(reply, "500") {
+		t.Errorf("expected 500 for EHLO in LMTP mode, got '%s'", reply)
+	}
+	if reply := smtpExchange(t, rw, "LHLO test"); !strings.HasPrefix(reply, "250") {
+		t.Errorf("expected 250 for LHLO, got '%s'", reply)
+	}
+	smtpExchange(t, rw, "MAIL FROM:<app@domain.com>")
+	smtpExchange(t, rw, "RCPT TO:<a@example.com>")
+	smtpExchange(t, rw, "RCPT TO:<b@example.com>")
+	if reply := smtpExchange(t, rw, "DATA"); !strings.HasPrefix(reply, "354") {
+		t.Fatalf("expected 354 for DATA, got '%s'", reply)
+	}
+	// A malformed header fails parsing before any Graph call
+	rw.WriteString("this is not a header\r\n\r\nbody\r\n.\r\n")
+	rw.Flush()
+	for i := 0; i < 2; i++ {
+		if reply := smtpExchange(t, rw, ""); !strings.HasPrefix(reply, "550 5.6.0") {
+			t.Errorf("recipient %d: expected 550 5.6.0, got '%s'", i+1, reply)
+		}
+	}
+}
+
+func TestServeConn_ImplicitTLSHandshakeTimeout(t *testing.T) {
+	setConfig(&tConfig{Timeouts: tTimeoutsConfig{Command: 100 * time.Millisecond}})
+	certFile, keyFile := testCertificate(t)
+	l := testListener(t, tListenerConfig{TLS: tlsModeImplicit, TLSCert: certFile, TLSKey: keyFile})
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		serveConn(server, l)
+		close(done)
+	}()
+	// The client connects and never starts the handshake
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Errorf("expected the connection to be closed when the client doesn't complete the handshake")
+	}
+}
+
+func TestServeConn_ImplicitTLSRefusedWithoutHandshake(t *testing.T) {
+	setConfig(&tConfig{})
+	certFile, keyFile := testCertificate(t)
+	l := testListener(t, tListenerConfig{TLS: tlsModeImplicit, TLSCert: certFile, TLSKey: keyFile, AllowedIPs: []string{"10.0.0.0/8"}})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			serveConn(conn, l)
+		}
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+	// No ClientHello is sent, a refused connection must be closed without waiting for one
+	if n, err := client.Read(make([]byte, 64)); n != 0 || err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected the connection to be closed without a reply, got %d bytes, error %v", n, err)
+	}
+}
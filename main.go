@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"log"
 
@@ -14,54 +19,209 @@ import (
 )
 
 // program implements service.Interface
-type program struct{}
+type program struct {
+	stop    chan struct{}
+	mu      sync.Mutex
+	lns     map[string]*tRunningListener // by address
+	adminLn net.Listener
+	httpSrv *http.Server
+	stopped bool // set by Stop, no listener is bound or reloaded afterwards
+}
 
 const version = "1.0.0"
 
 var (
 	logFile    *os.File
-	config     *tConfig
 	configFile string
 	logger     *slog.Logger
 	svcFlag    = flag.String("service", "", "Control the system service (start, stop, install, uninstall)")
 )
 
 func (p *program) Start(s service.Service) error {
-	// Start should not block. Do the actual work async.
-	go p.run()
+	// Start should not block. Bind the listeners here so failures are reported to the service manager,
+	// then do the actual work async.
+	c := getConfig()
+	if err := setHTTPClient(c.HTTPClient); err != nil {
+		logger.Error("Invalid http_client settings", "error", err)
+		return err
+	}
+	// Nothing is bound or started before spool_dir is usable, so a failure here leaves nothing to clean up
+	if c.SpoolDir != "" {
+		if err := os.MkdirAll(c.SpoolDir, 0700); err != nil {
+			logger.Error("Failed to create spool_dir", "dir", c.SpoolDir, "error", err)
+			return err
+		}
+		if err := rateLimiter.load(c.SpoolDir); err != nil {
+			logger.Error("Failed to load rate limit counters", "error", err)
+		}
+		if c.PersistTokens {
+			if err := loadTokenCache(c.SpoolDir); err != nil { // before any session can cache a token
+				logger.Error("Failed to load token cache", "error", err)
+			}
+		}
+	}
+	p.lns = map[string]*tRunningListener{}
+	if err := p.applyListeners(listenerConfigs(c)); err != nil {
+		logger.Error("Failed to start listeners", "error", err)
+		return err
+	}
+	if c.AdminAddr != "" {
+		adminLn, err := listenAdmin(c.AdminAddr)
+		if err != nil {
+			p.closeListeners()
+			logger.Error("Failed to listen", "addr", c.AdminAddr, "error", err)
+			return fmt.Errorf("failed to listen on admin address %s: %w", c.AdminAddr, err)
+		}
+		p.adminLn = adminLn
+		go adminServe(adminLn)
+	}
+	if c.HTTPAPI.ListenAddr != "" { // bound last, no error path below has to shut it down
+		httpLn, err := net.Listen("tcp", c.HTTPAPI.ListenAddr)
+		if err != nil {
+			p.closeListeners()
+			logger.Error("Failed to listen", "addr", c.HTTPAPI.ListenAddr, "error", err)
+			return fmt.Errorf("failed to listen on HTTP API address %s: %w", c.HTTPAPI.ListenAddr, err)
+		}
+		p.httpSrv = newAPIServer()
+		go func(srv *http.Server, a tHTTPAPIConfig) {
+			var err error
+			if a.TLSCert != "" {
+				err = srv.ServeTLS(httpLn, a.TLSCert, a.TLSKey)
+			} else {
+				err = srv.Serve(httpLn)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("HTTP API server failed", "error", err)
+			}
+		}(p.httpSrv, c.HTTPAPI)
+		logger.Info("HTTP API listening", "addr", httpLn.Addr().String())
+	}
+	if d := drainWindow(c); c.DrainTimeout > d {
+		logger.Warn("drain_timeout is capped so the service manager doesn't kill the process while stopping", "drain_timeout", c.DrainTimeout, "max", d)
+	}
+	go rateLimitMaintain(c.SpoolDir, p.stop)
+	if c.SpoolDir != "" && c.PersistTokens {
+		go tokenCachePersist(c.SpoolDir, p.stop)
+	}
+	if c.Pickup.Dir != "" {
+		go pickupWatch(c.Pickup, p.stop)
+		logger.Info("Watching pickup directory", "dir", c.Pickup.Dir)
+	}
+	go tokenRefresh(p.stop)
+	go p.reloadWatch(c.ConfigWatchInterval)
 	return nil
 }
 
-func (p *program) run() {
-	ln, err := net.Listen("tcp", config.ListenAddr)
-	if err != nil {
-		log.Fatalf("Failed to listen: %v", err)
-	}
-	defer ln.Close()
+func (p *program) run(rl *tRunningListener) {
+	defer rl.ln.Close()
+	var backoff time.Duration // like net/http: 5ms doubling up to 1s on transient errors
 	for {
-		conn, err := ln.Accept()
+		conn, err := rl.ln.Accept()
 		if err != nil {
-			log.Printf("Accept error: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
+			}
+			logger.Error("Accept error", "error", err, "retry_in", backoff)
+			time.Sleep(backoff)
 			continue
 		}
-		go handleSMTPConnection(conn)
+		backoff = 0
+		go serveConn(conn, rl.l.Load())
 	}
 }
 
 func (p *program) Stop(s service.Service) error {
-	// Stop should not block. Return with a few seconds.
-	log.Println("Service is stopping...")
+	// Stop blocks for the drain window, which is capped on Windows so the service manager doesn't kill the process first
+	logger.Info("Service is stopping...")
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	// Keep accepting during the drain window only to answer 421, let transactions in progress finish
+	draining.Store(true)
+	activeSessions.drain()
+	c := getConfig()
+	drainTimeout := drainWindow(c)
+	httpDone := make(chan struct{})
+	go func() {
+		defer close(httpDone)
+		if p.httpSrv != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+			defer cancel()
+			if err := p.httpSrv.Shutdown(ctx); err != nil {
+				p.httpSrv.Close()
+			}
+		}
+	}()
+	if !activeSessions.wait(drainTimeout) {
+		logger.Warn("Drain window expired, closing remaining sessions", "drain_timeout", drainTimeout)
+		activeSessions.closeAll()
+	}
+	<-httpDone
+	p.closeListeners()
+	close(p.stop)
+	if c.SpoolDir != "" {
+		if err := rateLimiter.save(c.SpoolDir); err != nil {
+			logger.Error("Failed to save rate limit counters", "error", err)
+		}
+		if c.PersistTokens {
+			if err := saveTokenCache(c.SpoolDir); err != nil {
+				logger.Error("Failed to save token cache", "error", err)
+			}
+		}
+	}
 	return nil
 }
 
+// closeListeners closes the SMTP and admin listeners
+func (p *program) closeListeners() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, rl := range p.lns {
+		rl.ln.Close()
+	}
+	if p.adminLn != nil {
+		p.adminLn.Close()
+	}
+}
+
 func main() {
-	configFile = filepath.Join(filepath.Dir(os.Args[0]), "config.yaml")
+	sendmail, sendmailArgs := sendmailMode(os.Args)
+	var configPath string
+	var sendmailOpts sendmailOptions
+	if sendmail { // sendmail options don't follow the flag package syntax
+		var err error
+		if sendmailOpts, err = parseSendmailArgs(sendmailArgs); err != nil {
+			fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+			os.Exit(exUsage)
+		}
+		configPath = sendmailOpts.config
+	} else {
+		flag.Parse()
+		configPath = *configFlag
+	}
+	configFile = resolveConfigFile(configPath)
+	if *checkCfg {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+		os.Exit(checkConfigMain(configFile, *checkLive))
+	}
 	if err := loadConfig(); err != nil {
+		if sendmail {
+			fmt.Fprintf(os.Stderr, "sendmail: failed to load config: %v\n", err)
+			os.Exit(exConfig)
+		}
 		log.Fatalf("failed to load config: %v", err)
 	}
 	if err := slogSetup(); err != nil {
 		log.Fatalf("failed to initialize logger: %v", err)
 	}
+	if sendmail {
+		os.Exit(sendmailMain(sendmailOpts))
+	}
 	flagsProcess()
 
 	logger.Info("azureSMTPwithOAuth (systems@work) Github: https://github.com/mmalcek/azureSMTPwithOAuth")
@@ -69,13 +229,21 @@ func main() {
 
 	defer logFile.Close()
 
-	prg := &program{}
+	prg := &program{stop: make(chan struct{})}
 	svcConfig := &service.Config{
 		Name:        "azureSMTPwithOAuth",
 		DisplayName: "azureSMTPwithOAuth",
 		Description: "azureSMTPwithOAuth (systems@work) is a service that provides SMTP functionality with OAuth authentication through the Microsoft Graph API. https://github.com/mmalcek/azureSMTPwithOAuth",
 	}
 
+	if configFile != defaultConfigFile() {
+		// The service manager starts the binary without our flags and environment
+		if abs, err := filepath.Abs(configFile); err == nil {
+			configFile = abs
+		}
+		svcConfig.Arguments = []string{"-config", configFile}
+	}
+
 	s, err := service.New(prg, svcConfig)
 	if err != nil {
 		logger.Error("service.New failed", "err", err)
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProgramStart_ListenError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer busy.Close()
+	setConfig(&tConfig{ListenAddr: busy.Addr().String()})
+	p := &program{stop: make(chan struct{})}
+	if err := p.Start(nil); err == nil {
+		t.Errorf("expected Start to return the bind error")
+	}
+}
+
+func TestProgramStart_SpoolDirError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := freeAddr(t)
+	setConfig(&tConfig{ListenAddr: addr, SpoolDir: filepath.Join(file, "spool")})
+	p := &program{stop: make(chan struct{})}
+	if err := p.Start(nil); err == nil {
+		t.Fatalf("expected Start to fail on an unusable spool_dir")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listener was left bound: %v", err)
+	}
+	ln.Close()
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func peerCredentials(conn net.Conn) (uid, pid int, err error) {
+	return 0, 0, errors.New("Peer credentials are not supported on non-Linux platforms")
+}
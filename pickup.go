@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tPickupConfig holds the IIS SMTP-style pickup directory settings
+type tPickupConfig struct {
+	Dir      string        `yaml:"dir"`
+	Interval time.Duration `yaml:"interval"`
+	Identity tIdentity     `yaml:"identity"`
+}
+
+const (
+	defaultPickupInterval = 5 * time.Second
+	pickupSettleTime      = 2 * time.Second // skip files still being written
+	pickupDoneDir         = "done"
+	pickupFailedDir       = "failed"
+	pickupRetryMin        = 30 * time.Second // first retry of a temporary failure, doubling up to pickupRetryMax
+	pickupRetryMax        = time.Hour
+)
+
+// pickupRetry is the state of a file whose delivery failed temporarily
+type pickupRetry struct {
+	id       string // kept across attempts for the logs and the done/failed file name
+	attempts int
+	next     time.Time
+	charged  bool // the rate limits were charged, later attempts don't count again
+}
+
+// pickupRetries holds the files waiting for a retry by path; only the pickupWatch goroutine uses it
+var pickupRetries = make(map[string]*pickupRetry)
+
+// pickupWatch polls the pickup directory until stop is closed
+func pickupWatch(c tPickupConfig, stop <-chan struct{}) {
+	for _, sub := range []string{pickupDoneDir, pickupFailedDir} {
+		if err := os.MkdirAll(filepath.Join(c.Dir, sub), 0700); err != nil {
+			logger.Error("Failed to create pickup subdirectory", "dir", c.Dir, "error", err)
+			return
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background()) // aborts a delivery in progress on stop
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	ticker := time.NewTicker(durationOrDefault(c.Interval, defaultPickupInterval))
+	defer ticker.Stop()
+	for {
+		pickupScan(ctx, c)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// pickupScan delivers every settled .eml file in the pickup directory until ctx is done
+func pickupScan(ctx context.Context, c tPickupConfig) {
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		logger.Error("Failed to read pickup directory", "dir", c.Dir, "error", err)
+		return
+	}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if e.IsDir() || !strings.EqualFold(filepath.Ext(e.Name()), ".eml") {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		path := filepath.Join(c.Dir, e.Name())
+		seen[path] = true
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < pickupSettleTime {
+			continue
+		}
+		if r := pickupRetries[path]; r != nil && time.Now().Before(r.next) {
+			continue
+		}
+		pickupProcess(ctx, c, path)
+	}
+	for path := range pickupRetries { // removed by someone else
+		if !seen[path] {
+			delete(pickupRetries, path)
+		}
+	}
+}
+
+// pickupProcess delivers one file and moves it to done or failed. Temporary failures stay in the
+// directory and are retried with a growing delay.
+func pickupProcess(ctx context.Context, c tPickupConfig, path string) {
+	r := pickupRetries[path]
+	if r == nil {
+		r = &pickupRetry{id: newMessageID()}
+	}
+	m := &tMessage{ID: r.id, Source: "pickup", Username: c.Identity.Username, Password: c.Identity.Password}
+	err := pickupDeliver(ctx, m, path, r)
+	var de *deliveryError
+	if errors.As(err, &de) && de.temporary() {
+		delay := pickupRetryMin << min(r.attempts, 10)
+		if delay > pickupRetryMax {
+			delay = pickupRetryMax
+		}
+		r.attempts++
+		r.next = time.Now().Add(delay)
+		pickupRetries[path] = r
+		logger.Warn("Pickup delivery deferred", "id", m.ID, "file", path, "error", err, "attempt", r.attempts, "retry_in", delay)
+		return
+	}
+	delete(pickupRetries, path)
+	// The message ID keeps files of the same name from overwriting each other
+	base := filepath.Base(path)
+	name := strings.TrimSuffix(base, filepath.Ext(base)) + "." + m.ID + filepath.Ext(base)
+	dest := pickupDoneDir
+	if err != nil {
+		dest = pickupFailedDir
+		logger.Error("Pickup delivery failed", "id", m.ID, "file", path, "error", err)
+		os.WriteFile(filepath.Join(c.Dir, pickupFailedDir, name+".error.txt"), []byte(err.Error()+"\n"), 0600)
+	}
+	if err := os.Rename(path, filepath.Join(c.Dir, dest, name)); err != nil {
+		logger.Error("Failed to move pickup file", "file", path, "to", dest, "error", err)
+	}
+}
+
+// pickupDeliver sends one file; the rate limits are charged only on the first attempt that passes them
+func pickupDeliver(ctx context.Context, m *tMessage, path string, r *pickupRetry) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > maxMessageSize(getConfig()) {
+		return &deliveryError{Reply: "552 5.3.4 Message size exceeds fixed maximum message size", Err: fmt.Errorf("file is %d bytes", len(data))}
+	}
+	raw := normalizeLineEndings(string(data))
+	if m.MailFrom, m.RcptTo, err = messageEnvelope(raw, m.Username); err != nil {
+		return err
+	}
+	if err := parseMessage(ctx, m, raw); err != nil {
+		return err
+	}
+	if !r.charged {
+		if err := checkMessagePolicy(m); err != nil {
+			return err
+		}
+		r.charged = true
+	}
+	return deliverMessage(ctx, m)
+}
+
+// messageEnvelope derives sender and recipients from X-Sender/X-Receiver headers (IIS pickup format)
+// or, if missing, from From and To/Cc/Bcc. defaultFrom is used when no sender can be found.
+func messageEnvelope(raw, defaultFrom string) (from string, rcpt []string, err error) {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return "", nil, &deliveryError{Reply: "550 5.6.0 Message parsing failed: " + err.Error(), Err: err}
+	}
+	h := msg.Header
+	from = strings.Trim(strings.TrimSpace(h.Get("X-Sender")), "<>")
+	if from == "" {
+		if addrs, err := h.AddressList("From"); err == nil && len(addrs) > 0 {
+			from = addrs[0].Address
+		}
+	}
+	if from == "" {
+		from = defaultFrom
+	}
+	for _, r := range h["X-Receiver"] {
+		if r = strings.Trim(strings.TrimSpace(r), "<>"); r != "" {
+			rcpt = append(rcpt, r)
+		}
+	}
+	if len(rcpt) == 0 {
+		for _, field := range []string{"To", "Cc", "Bcc"} {
+			addrs, err := h.AddressList(field)
+			if err != nil && !errors.Is(err, mail.ErrHeaderNotPresent) {
+				return "", nil, &deliveryError{Reply: "550 5.1.3 Invalid " + field + " header", Err: fmt.Errorf("invalid %s header: %w", field, err)}
+			}
+			for _, a := range addrs {
+				rcpt = append(rcpt, a.Address)
+			}
+		}
+	}
+	return from, rcpt, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMessageEnvelope_IISHeaders(t *testing.T) {
+	raw := "X-Sender: <app@domain.com>\r\nX-Receiver: <a@example.com>\r\nX-Receiver: b@example.com\r\nFrom: other@domain.com\r\nTo: c@example.com\r\nSubject: Hi\r\n\r\nBody\r\n"
+	from, rcpt, err := messageEnvelope(raw, "default@domain.com")
+	if err != nil {
+		t.Fatalf("messageEnvelope failed: %v", err)
+	}
+	if from != "app@domain.com" {
+		t.Errorf("expected sender from X-Sender, got '%s'", from)
+	}
+	if !reflect.DeepEqual(rcpt, []string{"a@example.com", "b@example.com"}) {
+		t.Errorf("expected recipients from X-Receiver only, got %v", rcpt)
+	}
+}
+
+func TestMessageEnvelope_AddressHeaders(t *testing.T) {
+	raw := "To: A <a@example.com>, b@example.com\r\nCc: c@example.com\r\nBcc: d@example.com\r\nSubject: Hi\r\n\r\nBody\r\n"
+	from, rcpt, err := messageEnvelope(raw, "default@domain.com")
+	if err != nil {
+		t.Fatalf("messageEnvelope failed: %v", err)
+	}
+	if from != "default@domain.com" {
+		t.Errorf("expected default sender, got '%s'", from)
+	}
+	if !reflect.DeepEqual(rcpt, []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"}) {
+		t.Errorf("expected To/Cc/Bcc recipients, got %v", rcpt)
+	}
+}
+
+func TestPickupProcess_FailedMovesFile(t *testing.T) {
+	setConfig(&tConfig{RecipientPolicy: tRecipientPolicy{BlockedDomains: []string{"spam.com"}}})
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, pickupFailedDir), 0700)
+	path := filepath.Join(dir, "msg.eml")
+	os.WriteFile(path, []byte("To: you@spam.com\nSubject: Hi\n\nBody\n"), 0600)
+	pickupProcess(context.Background(), tPickupConfig{Dir: dir, Identity: tIdentity{Username: "app@domain.com"}}, path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected file to be moved out of the pickup directory")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, pickupFailedDir, "msg.*.eml")); len(files) != 1 {
+		t.Errorf("expected file in failed directory, got %v", files)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, pickupFailedDir, "msg.*.eml.error.txt")); len(files) != 1 {
+		t.Errorf("expected error note in failed directory, got %v", files)
+	}
+}
+
+func TestPickupProcess_DeferredChargesOnce(t *testing.T) {
+	fakeTokenEndpoint(t, 0)
+	graph := fakeGraphEndpoint(t, http.StatusServiceUnavailable, "")
+	setConfig(&tConfig{OAuth2Config: tOAuth2Config{TenantID: "contoso.onmicrosoft.com"},
+		RateLimits: tRateLimitsConfig{PerMailbox: tRateLimit{MessagesPerDay: 1}}})
+	saved := rateLimiter
+	rateLimiter = newRateLimiter()
+	t.Cleanup(func() {
+		rateLimiter = saved
+		clear(pickupRetries)
+	})
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, pickupDoneDir), 0700)
+	path := filepath.Join(dir, "msg.eml")
+	os.WriteFile(path, []byte("From: app@domain.com\nTo: a@example.com\nSubject: Hi\n\nBody\n"), 0600)
+	c := tPickupConfig{Dir: dir, Identity: tIdentity{Username: "app@domain.com", Password: "good"}}
+
+	pickupProcess(context.Background(), c, path)
+	r := pickupRetries[path]
+	if r == nil || !r.next.After(time.Now()) {
+		t.Fatalf("expected the file to wait for a retry, got %+v", r)
+	}
+	pickupScan(context.Background(), c) // before r.next: skipped
+	if graph.count() != 1 {
+		t.Errorf("expected no retry before the backoff expired, got %d Graph requests", graph.count())
+	}
+	r.next = time.Now()
+	pickupProcess(context.Background(), c, path)
+	if graph.count() != 2 {
+		t.Errorf("expected the retry to reach Graph without charging the daily quota again, got %d Graph requests", graph.count())
+	}
+	if r.attempts != 2 || pickupRetries[path].id != r.id {
+		t.Errorf("expected one retry state across attempts, got %+v", pickupRetries[path])
+	}
+}
+
+func TestPickupProcess_UniqueDoneNames(t *testing.T) {
+	fakeTokenEndpoint(t, 0)
+	fakeGraphEndpoint(t, http.StatusAccepted, "")
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, pickupDoneDir), 0700)
+	c := tPickupConfig{Dir: dir, Identity: tIdentity{Username: "app@domain.com", Password: "good"}}
+	path := filepath.Join(dir, "msg.eml")
+	for i := 0; i < 2; i++ {
+		os.WriteFile(path, []byte("To: a@example.com\nSubject: Hi\n\nBody\n"), 0600)
+		pickupProcess(context.Background(), c, path)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, pickupDoneDir, "msg.*.eml")); len(files) != 2 {
+		t.Errorf("expected two files of the same name in done, got %v", files)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+)
+
+// tRecipientPolicy holds the RCPT TO allow/deny rules
+type tRecipientPolicy struct {
+	InternalDomains     []string `yaml:"internal_domains"`
+	InternalOnlySenders []string `yaml:"internal_only_senders"`
+	BlockedDomains      []string `yaml:"blocked_domains"`
+	MaxRecipients       int      `yaml:"max_recipients"`
+}
+
+// checkRecipient validates a single RCPT TO address against the recipient policy.
+// It returns an empty string if the recipient is accepted, otherwise the SMTP reply to send.
+func checkRecipient(p tRecipientPolicy, username, addr string, accepted int) string {
+	if p.MaxRecipients > 0 && accepted >= p.MaxRecipients {
+		return "452 4.5.3 Too many recipients"
+	}
+	domain := addressDomain(addr)
+	if domain == "" {
+		return "550 5.7.1 Recipient address rejected: invalid address"
+	}
+	if domainMatches(domain, p.BlockedDomains) {
+		return "550 5.7.1 Recipient address rejected: domain is blocked"
+	}
+	if isInternalOnlySender(p, username) && !domainMatches(domain, p.InternalDomains) {
+		return "550 5.7.1 Recipient address rejected: sender may only send to internal domains"
+	}
+	return ""
+}
+
+// isInternalOnlySender reports whether the identity is restricted to internal domains.
+// Entries may be full addresses (app@domain.com) or whole domains (@domain.com).
+func isInternalOnlySender(p tRecipientPolicy, username string) bool {
+	username = strings.ToLower(strings.TrimSpace(username))
+	for _, s := range p.InternalOnlySenders {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "" {
+			continue
+		}
+		if s == username || (strings.HasPrefix(s, "@") && strings.HasSuffix(username, s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressDomain returns the lower-cased domain part of an e-mail address
+func addressDomain(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at == -1 || at == len(addr)-1 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(addr[at+1:]))
+}
+
+// domainMatches reports whether domain equals or is a subdomain of any entry in list
+func domainMatches(domain string, list []string) bool {
+	for _, d := range list {
+		d = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "@"))
+		if d == "" {
+			continue
+		}
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
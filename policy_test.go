@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckRecipient_Allowed(t *testing.T) {
+	p := tRecipientPolicy{BlockedDomains: []string{"spam.com"}}
+	if reply := checkRecipient(p, "user@domain.com", "you@example.com", 0); reply != "" {
+		t.Errorf("expected recipient to be accepted, got '%s'", reply)
+	}
+}
+
+func TestCheckRecipient_BlockedDomain(t *testing.T) {
+	p := tRecipientPolicy{BlockedDomains: []string{"spam.com"}}
+	reply := checkRecipient(p, "user@domain.com", "you@mail.spam.com", 0)
+	if !strings.HasPrefix(reply, "550 5.7.1") {
+		t.Errorf("expected 550 5.7.1 for blocked subdomain, got '%s'", reply)
+	}
+}
+
+func TestCheckRecipient_InternalOnly(t *testing.T) {
+	p := tRecipientPolicy{
+		InternalDomains:     []string{"domain.com"},
+		InternalOnlySenders: []string{"app@domain.com", "@internal.domain.com"},
+	}
+	if reply := checkRecipient(p, "App@Domain.com", "you@domain.com", 0); reply != "" {
+		t.Errorf("expected internal recipient to be accepted, got '%s'", reply)
+	}
+	if reply := checkRecipient(p, "app@domain.com", "you@example.com", 0); !strings.HasPrefix(reply, "550 5.7.1") {
+		t.Errorf("expected 550 5.7.1 for external recipient, got '%s'", reply)
+	}
+	if reply := checkRecipient(p, "cron@internal.domain.com", "you@example.com", 0); !strings.HasPrefix(reply, "550 5.7.1") {
+		t.Errorf("expected 550 5.7.1 for domain-wide internal-only sender, got '%s'", reply)
+	}
+	if reply := checkRecipient(p, "user@domain.com", "you@example.com", 0); reply != "" {
+		t.Errorf("expected unrestricted sender to be accepted, got '%s'", reply)
+	}
+}
+
+func TestCheckRecipient_MaxRecipients(t *testing.T) {
+	p := tRecipientPolicy{MaxRecipients: 2}
+	if reply := checkRecipient(p, "user@domain.com", "you@example.com", 1); reply != "" {
+		t.Errorf("expected recipient to be accepted, got '%s'", reply)
+	}
+	if reply := checkRecipient(p, "user@domain.com", "you@example.com", 2); !strings.HasPrefix(reply, "452 4.5.3") {
+		t.Errorf("expected 452 4.5.3, got '%s'", reply)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HAProxy PROXY protocol (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyConn is a connection whose remote address was taken from a PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+var errUntrustedProxy = errors.New("peer is not a trusted proxy")
+
+// acceptProxyHeader reads the PROXY header from a trusted proxy and returns a connection
+// reporting the real client address. Connections from untrusted peers fail with errUntrustedProxy,
+// or are returned unchanged with allowDirect.
+func acceptProxyHeader(conn net.Conn, trusted []*net.IPNet, allowDirect bool) (net.Conn, error) {
+	if !ipInNets(remoteIP(conn.RemoteAddr()), trusted) {
+		if allowDirect {
+			return conn, nil
+		}
+		return nil, errUntrustedProxy
+	}
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	r := bufio.NewReader(conn)
+	addr, err := readProxyHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if addr == nil { // LOCAL / UNKNOWN: health checks from the proxy itself
+		addr = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, r: r, remote: addr}, nil
+}
+
+// readProxyHeader parses a v1 or v2 PROXY header. It returns a nil address for LOCAL and UNKNOWN.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	prefix, err := r.Peek(6)
+	if err != nil {
+		return nil, fmt.Errorf("PROXY header: %w", err)
+	}
+	if string(prefix) != "PROXY " {
+		return nil, errors.New("PROXY header missing")
+	}
+	return readProxyV1(r)
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 { // maximum v1 header length including CRLF
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("PROXY v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header too long or not terminated")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid PROXY v1 source address %q", fields[2]+" "+fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("PROXY v2 header: %w", err)
+	}
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY v2 version %d", verCmd>>4)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("PROXY v2 addresses: %w", err)
+	}
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", verCmd&0x0f)
+	}
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		if length < 12 {
+			return nil, errors.New("PROXY v2 IPv4 address block too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if length < 36 {
+			return nil, errors.New("PROXY v2 IPv6 address block too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil // AF_UNSPEC / AF_UNIX: keep the proxy address
+}
+
+// ipInNets reports whether ip is contained in any of nets
+func ipInNets(ip string, nets []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader_V1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 203.0.113.7 10.0.0.1 51234 25\r\nEHLO test\r\n"))
+	addr, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatalf("readProxyHeader failed: %v", err)
+	}
+	if addr.String() != "203.0.113.7:51234" {
+		t.Errorf("expected 203.0.113.7:51234, got '%s'", addr)
+	}
+	rest, _ := r.ReadString('\n')
+	if rest != "EHLO test\r\n" {
+		t.Errorf("expected SMTP data after header to be preserved, got '%s'", rest)
+	}
+}
+
+func TestReadProxyHeader_V1Unknown(t *testing.T) {
+	addr, err := readProxyHeader(bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n")))
+	if err != nil || addr != nil {
+		t.Errorf("expected nil address without error, got %v, %v", addr, err)
+	}
+}
+
+func TestReadProxyHeader_V2(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.Write([]byte{0x21, 0x11}) // v2 PROXY, TCP over IPv4
+	binary.Write(&buf, binary.BigEndian, uint16(12))
+	buf.Write(net.ParseIP("198.51.100.9").To4())
+	buf.Write(net.ParseIP("10.0.0.1").To4())
+	binary.Write(&buf, binary.BigEndian, uint16(40000))
+	binary.Write(&buf, binary.BigEndian, uint16(25))
+	buf.WriteString("EHLO test\r\n")
+	r := bufio.NewReader(&buf)
+	addr, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatalf("readProxyHeader failed: %v", err)
+	}
+	if addr.String() != "198.51.100.9:40000" {
+		t.Errorf("expected 198.51.100.9:40000, got '%s'", addr)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "EHLO test\r\n" {
+		t.Errorf("expected SMTP data after header to be preserved, got '%s'", rest)
+	}
+}
+
+func TestReadProxyHeader_Invalid(t *testing.T) {
+	if _, err := readProxyHeader(bufio.NewReader(strings.NewReader("EHLO test\r\n"))); err == nil {
+		t.Errorf("expected error for missing header")
+	}
+	if _, err := readProxyHeader(bufio.NewReader(strings.NewReader("PROXY TCP4 bogus 10.0.0.1 1 25\r\n"))); err == nil {
+		t.Errorf("expected error for invalid source address")
+	}
+}
+
+func TestAcceptProxyHeader_TrustedOnly(t *testing.T) {
+	trusted, _ := parseIPNets([]string{"10.0.0.0/8"})
+	client, server := net.Pipe() // net.Pipe addresses are not IPs, so the peer is untrusted
+	defer client.Close()
+	if _, err := acceptProxyHeader(server, trusted, false); !errors.Is(err, errUntrustedProxy) {
+		t.Errorf("expected untrusted connection to be refused, got %v", err)
+	}
+	conn, err := acceptProxyHeader(server, trusted, true)
+	if err != nil {
+		t.Fatalf("acceptProxyHeader failed: %v", err)
+	}
+	if conn != server {
+		t.Errorf("expected untrusted connection to be returned unchanged with proxy_allow_direct")
+	}
+}
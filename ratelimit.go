@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tRateLimitsConfig holds the rate limits per authenticated user, source IP and target mailbox
+type tRateLimitsConfig struct {
+	PerUser    tRateLimit `yaml:"per_user"`
+	PerIP      tRateLimit `yaml:"per_ip"`
+	PerMailbox tRateLimit `yaml:"per_mailbox"`
+}
+
+// tRateLimit holds token-bucket rates and daily quotas. Zero means unlimited.
+type tRateLimit struct {
+	MessagesPerMinute   float64 `yaml:"messages_per_minute"`
+	RecipientsPerMinute float64 `yaml:"recipients_per_minute"`
+	MessagesPerDay      int     `yaml:"messages_per_day"`
+	RecipientsPerDay    int     `yaml:"recipients_per_day"`
+}
+
+const rateLimitStateFile = "ratelimit.json"
+
+// rateBucket is a token bucket; capacity equals the per-minute rate
+type rateBucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+type rateCounter struct {
+	Messages      rateBucket `json:"messages"`
+	Recipients    rateBucket `json:"recipients"`
+	Day           string     `json:"day"`
+	DayMessages   int        `json:"day_messages"`
+	DayRecipients int        `json:"day_recipients"`
+}
+
+// tRateLimiter keeps the counters for all keys (thread-safe)
+type tRateLimiter struct {
+	mu       sync.Mutex
+	counters map[string]*rateCounter
+	dirty    bool
+	now      func() time.Time
+}
+
+var rateLimiter = newRateLimiter()
+
+func newRateLimiter() *tRateLimiter {
+	return &tRateLimiter{counters: make(map[string]*rateCounter), now: time.Now}
+}
+
+// rateLimitKey pairs a counter key with the limit that applies to it
+type rateLimitKey struct {
+	key   string
+	limit tRateLimit
+}
+
+// rateLimitKeys returns the counters that apply to a message. mailbox is the mailbox of the Graph
+// sendMail URL, the one Graph throttles; never the client-controlled MAIL FROM.
+func rateLimitKeys(c tRateLimitsConfig, username, ip, mailbox string) []rateLimitKey {
+	return []rateLimitKey{
+		{"user:" + strings.ToLower(username), c.PerUser},
+		{"ip:" + ip, c.PerIP},
+		{"mailbox:" + strings.ToLower(mailbox), c.PerMailbox},
+	}
+}
+
+// allow checks all keys for one message with the given number of recipients.
+// The message is only counted if every key is within its limits; otherwise the reason is returned.
+func (r *tRateLimiter) allow(keys []rateLimitKey, recipients int) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	day := now.UTC().Format("2006-01-02")
+	for _, k := range keys {
+		c := r.counter(k.key, k.limit, now, day)
+		l := k.limit
+		if l.MessagesPerDay > 0 && c.DayMessages+1 > l.MessagesPerDay {
+			return k.key + ": daily message quota exceeded", false
+		}
+		if l.RecipientsPerDay > 0 && c.DayRecipients+recipients > l.RecipientsPerDay {
+			return k.key + ": daily recipient quota exceeded", false
+		}
+		if l.MessagesPerMinute > 0 && c.Messages.Tokens < 1 {
+			return k.key + ": message rate exceeded", false
+		}
+		if l.RecipientsPerMinute > 0 && c.Recipients.Tokens < float64(recipients) && c.Recipients.Tokens < l.RecipientsPerMinute {
+			return k.key + ": recipient rate exceeded", false
+		}
+	}
+	for _, k := range keys {
+		c := r.counters[k.key]
+		c.DayMessages++
+		c.DayRecipients += recipients
+		if k.limit.MessagesPerMinute > 0 {
+			c.Messages.Tokens--
+		}
+		if k.limit.RecipientsPerMinute > 0 {
+			// A message with more recipients than the bucket holds is allowed from a full bucket and drains it
+			c.Recipients.Tokens -= float64(recipients)
+			if c.Recipients.Tokens < 0 {
+				c.Recipients.Tokens = 0
+			}
+		}
+	}
+	r.dirty = true
+	return "", true
+}
+
+// counter returns the refilled counter for key, creating it if needed (r.mu must be held)
+func (r *tRateLimiter) counter(key string, l tRateLimit, now time.Time, day string) *rateCounter {
+	c, ok := r.counters[key]
+	if !ok {
+		c = &rateCounter{
+			Messages:   rateBucket{Tokens: l.MessagesPerMinute, Updated: now},
+			Recipients: rateBucket{Tokens: l.RecipientsPerMinute, Updated: now},
+			Day:        day,
+		}
+		r.counters[key] = c
+	}
+	c.Messages.refill(l.MessagesPerMinute, now)
+	c.Recipients.refill(l.RecipientsPerMinute, now)
+	if c.Day != day {
+		c.Day = day
+		c.DayMessages = 0
+		c.DayRecipients = 0
+	}
+	return c
+}
+
+func (b *rateBucket) refill(perMinute float64, now time.Time) {
+	if elapsed := now.Sub(b.Updated); elapsed > 0 {
+		b.Tokens += elapsed.Minutes() * perMinute
+	}
+	if b.Tokens > perMinute {
+		b.Tokens = perMinute
+	}
+	b.Updated = now
+}
+
+// prune drops counters that are back to their initial state (r.mu must be held)
+func (r *tRateLimiter) prune(now time.Time) {
+	day := now.UTC().Format("2006-01-02")
+	for key, c := range r.counters {
+		if c.Day != day && now.Sub(c.Messages.Updated) > time.Hour && now.Sub(c.Recipients.Updated) > time.Hour {
+			delete(r.counters, key)
+		}
+	}
+}
+
+// load reads persisted counters from the spool directory
+func (r *tRateLimiter) load(spoolDir string) error {
+	data, err := os.ReadFile(filepath.Join(spoolDir, rateLimitStateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	counters := make(map[string]*rateCounter)
+	if err := json.Unmarshal(data, &counters); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", rateLimitStateFile, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters = counters
+	return nil
+}
+
+// save writes the counters to the spool directory if they changed since the last save
+func (r *tRateLimiter) save(spoolDir string) error {
+	r.mu.Lock()
+	if !r.dirty {
+		r.mu.Unlock()
+		return nil
+	}
+	r.prune(r.now())
+	data, err := json.Marshal(r.counters)
+	r.dirty = false
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(spoolDir, rateLimitStateFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// pruneStale drops idle counters so keys seen once don't stay in memory
+func (r *tRateLimiter) pruneStale() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune(r.now())
+}
+
+// rateLimitMaintain prunes the counters periodically and, with a spool directory, saves them, until stop is closed
+func rateLimitMaintain(spoolDir string, stop <-chan struct{}) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		rateLimiter.pruneStale()
+		if spoolDir == "" {
+			continue
+		}
+		if err := rateLimiter.save(spoolDir); err != nil {
+			logger.Error("Failed to save rate limit counters", "error", err)
+		}
+	}
+}
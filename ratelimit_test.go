@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_MessageRate(t *testing.T) {
+	r := newRateLimiter()
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	keys := rateLimitKeys(tRateLimitsConfig{PerUser: tRateLimit{MessagesPerMinute: 2}}, "app@domain.com", "10.0.0.1", "app@domain.com")
+	for i := 0; i < 2; i++ {
+		if reason, ok := r.allow(keys, 1); !ok {
+			t.Fatalf("message %d: expected allow, got '%s'", i+1, reason)
+		}
+	}
+	if _, ok := r.allow(keys, 1); ok {
+		t.Fatalf("expected third message to be rate limited")
+	}
+	now = now.Add(30 * time.Second)
+	if reason, ok := r.allow(keys, 1); !ok {
+		t.Errorf("expected allow after refill, got '%s'", reason)
+	}
+}
+
+func TestRateLimiter_DailyRecipientQuota(t *testing.T) {
+	r := newRateLimiter()
+	now := time.Date(2025, 1, 1, 23, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	keys := rateLimitKeys(tRateLimitsConfig{PerMailbox: tRateLimit{RecipientsPerDay: 10}}, "app@domain.com", "10.0.0.1", "app@domain.com")
+	if _, ok := r.allow(keys, 8); !ok {
+		t.Fatalf("expected first message to be allowed")
+	}
+	if _, ok := r.allow(keys, 3); ok {
+		t.Fatalf("expected quota to be exceeded")
+	}
+	if _, ok := r.allow(keys, 2); !ok {
+		t.Errorf("expected message within remaining quota to be allowed")
+	}
+	now = now.Add(2 * time.Hour)
+	if _, ok := r.allow(keys, 10); !ok {
+		t.Errorf("expected quota to reset on the next day")
+	}
+}
+
+func TestRateLimiter_RejectedMessageNotCounted(t *testing.T) {
+	r := newRateLimiter()
+	c := tRateLimitsConfig{
+		PerUser: tRateLimit{MessagesPerDay: 5},
+		PerIP:   tRateLimit{MessagesPerDay: 1},
+	}
+	if _, ok := r.allow(rateLimitKeys(c, "a@domain.com", "10.0.0.1", "a@domain.com"), 1); !ok {
+		t.Fatalf("expected first message to be allowed")
+	}
+	if _, ok := r.allow(rateLimitKeys(c, "a@domain.com", "10.0.0.1", "a@domain.com"), 1); ok {
+		t.Fatalf("expected IP quota to be exceeded")
+	}
+	if got := r.counters["user:a@domain.com"].DayMessages; got != 1 {
+		t.Errorf("expected rejected message not to count against the user, got %d", got)
+	}
+}
+
+func TestRateLimiter_Persistence(t *testing.T) {
+	dir := t.TempDir()
+	r := newRateLimiter()
+	keys := rateLimitKeys(tRateLimitsConfig{PerUser: tRateLimit{MessagesPerDay: 1}}, "a@domain.com", "10.0.0.1", "a@domain.com")
+	r.allow(keys, 1)
+	if err := r.save(dir); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	r2 := newRateLimiter()
+	if err := r2.load(dir); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if _, ok := r2.allow(keys, 1); ok {
+		t.Errorf("expected restored counters to enforce the daily quota")
+	}
+}
+
+func TestRateLimiter_PruneWithoutSpool(t *testing.T) {
+	r := newRateLimiter()
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	r.allow(rateLimitKeys(tRateLimitsConfig{}, "a@domain.com", "10.0.0.1", "a@domain.com"), 1)
+	if len(r.counters) == 0 {
+		t.Fatalf("expected counters for the message")
+	}
+	now = now.Add(25 * time.Hour)
+	r.pruneStale()
+	if n := len(r.counters); n != 0 {
+		t.Errorf("expected idle counters to be pruned, %d left", n)
+	}
+}
+
+// Rotating MAIL FROM must not get a client a fresh per_mailbox quota
+func TestHandleSMTPConnection_MailboxLimitIgnoresMailFrom(t *testing.T) {
+	setConfig(&tConfig{RateLimits: tRateLimitsConfig{PerMailbox: tRateLimit{MessagesPerDay: 1}}})
+	saved := rateLimiter
+	rateLimiter = newRateLimiter()
+	t.Cleanup(func() { rateLimiter = saved })
+	l := testListener(t, tListenerConfig{DefaultIdentity: tIdentity{Username: "app@domain.com", Password: "secret"}})
+	for i, from := range []string{"a@domain.com", "b@domain.com"} {
+		client, server := net.Pipe()
+		go handleSMTPConnection(server, l)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		rw := bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
+		smtpExchange(t, rw, "")
+		smtpExchange(t, rw, "MAIL FROM:<"+from+">")
+		smtpExchange(t, rw, "RCPT TO:<x@example.com>")
+		reply := smtpExchange(t, rw, "DATA")
+		if i == 0 && !strings.HasPrefix(reply, "354") {
+			t.Fatalf("expected the first message to be accepted, got '%s'", reply)
+		}
+		if i == 1 && !strings.HasPrefix(reply, "451 4.7.1") {
+			t.Errorf("expected the mailbox quota to apply whatever MAIL FROM says, got '%s'", reply)
+		}
+		client.Close()
+	}
+}
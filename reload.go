@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const defaultConfigWatchInterval = 5 * time.Second
+
+var errStopped = errors.New("service stopped")
+
+// tRunningListener is a bound listener; a reload swaps its settings without rebinding the socket
+type tRunningListener struct {
+	ln net.Listener
+	l  atomic.Pointer[tListener]
+}
+
+// applyListeners brings the running listeners in line with cfgs: new addresses are bound, existing ones
+// get the new settings for new connections, removed ones are closed. Sessions in progress are not touched.
+// If a listener is invalid or can't be bound nothing is changed. Once the program is stopped it fails with errStopped.
+func (p *program) applyListeners(cfgs []tListenerConfig) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return errStopped
+	}
+	listeners := make(map[string]*tListener, len(cfgs))
+	for _, lc := range cfgs {
+		lc.AuthMechanisms = append([]string{}, lc.AuthMechanisms...) // newListener normalizes in place
+		l, err := newListener(lc)
+		if err != nil {
+			return err
+		}
+		if listeners[l.Addr] != nil {
+			return fmt.Errorf("duplicate listener address %s", l.Addr)
+		}
+		listeners[l.Addr] = l
+	}
+	added := map[string]*tRunningListener{}
+	for addr, l := range listeners {
+		if p.lns[addr] != nil {
+			continue
+		}
+		ln, err := l.listen()
+		if err != nil {
+			for _, rl := range added {
+				rl.ln.Close()
+			}
+			return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		rl := &tRunningListener{ln: ln}
+		rl.l.Store(l)
+		added[addr] = rl
+	}
+	for addr, rl := range p.lns {
+		if l, ok := listeners[addr]; ok {
+			rl.l.Store(l)
+			continue
+		}
+		logger.Info("Listener removed", "addr", addr)
+		rl.ln.Close()
+		delete(p.lns, addr)
+	}
+	for addr, rl := range added {
+		p.lns[addr] = rl
+		logger.Info("Listening", "addr", rl.ln.Addr().String(), "tls", rl.l.Load().TLS)
+		go p.run(rl)
+	}
+	return nil
+}
+
+// reload re-reads the config file and applies it. A config with problems is rejected and the running one kept.
+func (p *program) reload() error {
+	p.mu.Lock()
+	stopped := p.stopped
+	p.mu.Unlock()
+	if stopped {
+		return nil
+	}
+	c, problems := checkConfigFile(configFile)
+	if len(problems) > 0 {
+		for _, pr := range problems {
+			logger.Error("Invalid config", "file", configFile, "problem", pr.String())
+		}
+		return fmt.Errorf("config %s has %d problem(s), keeping the running config", configFile, len(problems))
+	}
+	old := getConfig()
+	if err := p.applyListeners(listenerConfigs(c)); errors.Is(err, errStopped) {
+		return nil // Stop won the race
+	} else if err != nil {
+		logger.Error("Failed to apply listeners, keeping the running config", "file", configFile, "error", err)
+		return err
+	}
+	setConfig(c)
+	logLevel.Set(parseLogLevel(c.LogLevel))
+	if old.HTTPClient != c.HTTPClient {
+		if err := setHTTPClient(c.HTTPClient); err != nil { // checked above, unless the CA bundle just went away
+			logger.Error("Failed to apply http_client settings, keeping the old ones", "error", err)
+		}
+	}
+	if !reflect.DeepEqual(old.OAuth2Config, c.OAuth2Config) || !reflect.DeepEqual(old.Tenants, c.Tenants) {
+		TokenCache.Clear() // tokens of the old app registration or tenant
+	}
+	for _, name := range restartRequired(old, c) {
+		logger.Warn("Config change takes effect after a restart", "setting", name)
+	}
+	logger.Info("Config reloaded", "file", configFile)
+	return nil
+}
+
+// restartRequired lists the changed settings that are only read at startup
+func restartRequired(old, c *tConfig) []string {
+	var names []string
+	check := func(name string, changed bool) {
+		if changed {
+			names = append(names, name)
+		}
+	}
+	check("log", old.Log != c.Log)
+	check("admin_addr", old.AdminAddr != c.AdminAddr)
+	check("http_api.listen_addr", old.HTTPAPI.ListenAddr != c.HTTPAPI.ListenAddr)
+	check("http_api.tls_cert", old.HTTPAPI.TLSCert != c.HTTPAPI.TLSCert || old.HTTPAPI.TLSKey != c.HTTPAPI.TLSKey)
+	check("spool_dir", old.SpoolDir != c.SpoolDir)
+	check("persist_tokens", old.PersistTokens != c.PersistTokens)
+	check("pickup", !reflect.DeepEqual(old.Pickup, c.Pickup))
+	check("config_watch_interval", old.ConfigWatchInterval != c.ConfigWatchInterval)
+	oldSockets := map[string]tListenerConfig{}
+	for _, lc := range listenerConfigs(old) {
+		oldSockets[lc.Addr] = lc
+	}
+	for _, lc := range listenerConfigs(c) {
+		if o, ok := oldSockets[lc.Addr]; ok && (o.SocketMode != lc.SocketMode || o.SocketOwner != lc.SocketOwner) {
+			check("listeners "+lc.Addr+" socket_mode/socket_owner", true)
+		}
+	}
+	return names
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func configFileStamp(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{fi.ModTime(), fi.Size()}
+}
+
+// reloadWatch reloads the config on SIGHUP and when the config file changes, until stop is closed.
+// A negative interval disables the file watch.
+func (p *program) reloadWatch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if interval >= 0 {
+		ticker := time.NewTicker(durationOrDefault(interval, defaultConfigWatchInterval))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	last := configFileStamp(configFile)
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-hup:
+			logger.Info("SIGHUP received, reloading config", "file", configFile)
+		case <-tick:
+			if configFileStamp(configFile) == last {
+				continue
+			}
+			logger.Info("Config file changed, reloading", "file", configFile)
+		}
+		last = configFileStamp(configFile)
+		p.reload()
+	}
+}
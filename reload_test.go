@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestApplyListeners(t *testing.T) {
+	p := &program{stop: make(chan struct{}), lns: map[string]*tRunningListener{}}
+	defer p.closeListeners()
+	a, b := freeAddr(t), freeAddr(t)
+	if err := p.applyListeners([]tListenerConfig{{Addr: a}}); err != nil {
+		t.Fatalf("applyListeners failed: %v", err)
+	}
+	first := p.lns[a]
+
+	// a gets new settings without a rebind, b is added
+	if err := p.applyListeners([]tListenerConfig{{Addr: a, RequireAuth: true}, {Addr: b}}); err != nil {
+		t.Fatalf("applyListeners failed: %v", err)
+	}
+	if p.lns[a] != first || !p.lns[a].l.Load().RequireAuth || p.lns[b] == nil {
+		t.Errorf("expected %s updated in place and %s added", a, b)
+	}
+
+	// An invalid listener changes nothing
+	if err := p.applyListeners([]tListenerConfig{{Addr: b, TLS: "bogus"}}); err == nil {
+		t.Errorf("expected error for invalid listener")
+	}
+	if len(p.lns) != 2 {
+		t.Errorf("expected both listeners to be kept, got %d", len(p.lns))
+	}
+
+	// a is removed and closed
+	if err := p.applyListeners([]tListenerConfig{{Addr: b}}); err != nil {
+		t.Fatalf("applyListeners failed: %v", err)
+	}
+	if p.lns[a] != nil || len(p.lns) != 1 {
+		t.Errorf("expected %s to be removed", a)
+	}
+	if conn, err := net.Dial("tcp", a); err == nil {
+		conn.Close()
+		t.Errorf("expected %s to be closed", a)
+	}
+}
+
+func TestReload(t *testing.T) {
+	saved, savedFile := getConfig(), configFile
+	defer func() { setConfig(saved); configFile = savedFile }()
+	configFile = filepath.Join(t.TempDir(), "config.yaml")
+	addr := freeAddr(t)
+	valid := "listen_addr: " + addr + "\noauth2_config:\n    client_id: id\n    client_secret: secret\n    tenant_id: contoso.onmicrosoft.com\n    scopes: [https://graph.microsoft.com/.default]\n"
+	os.WriteFile(configFile, []byte(valid+"recipient_policy:\n    max_recipients: 5\n"), 0600)
+	setConfig(&tConfig{ListenAddr: addr})
+	p := &program{stop: make(chan struct{}), lns: map[string]*tRunningListener{}}
+	defer p.closeListeners()
+	if err := p.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if getConfig().RecipientPolicy.MaxRecipients != 5 || p.lns[addr] == nil {
+		t.Errorf("expected new config to be active, got %+v", getConfig())
+	}
+
+	os.WriteFile(configFile, []byte(valid+"recipient_policy:\n    max_recipent: 1\n"), 0600)
+	if err := p.reload(); err == nil {
+		t.Errorf("expected reload to reject unknown field")
+	}
+	if getConfig().RecipientPolicy.MaxRecipients != 5 {
+		t.Errorf("expected running config to be kept")
+	}
+}
+
+func TestReload_AfterStop(t *testing.T) {
+	saved, savedFile := getConfig(), configFile
+	defer func() { setConfig(saved); configFile = savedFile }()
+	configFile = filepath.Join(t.TempDir(), "config.yaml")
+	addr := freeAddr(t)
+	os.WriteFile(configFile, []byte("listen_addr: "+addr+"\noauth2_config:\n    client_id: id\n    client_secret: secret\n    tenant_id: contoso.onmicrosoft.com\n    scopes: [https://graph.microsoft.com/.default]\n"), 0600)
+	setConfig(&tConfig{})
+	p := &program{stop: make(chan struct{}), lns: map[string]*tRunningListener{}, stopped: true}
+	defer p.closeListeners()
+	if err := p.reload(); err != nil {
+		t.Errorf("expected reload after Stop to do nothing, got %v", err)
+	}
+	if len(p.lns) != 0 || getConfig().ListenAddr != "" {
+		t.Errorf("expected no listener to be bound after Stop, got %v", p.lns)
+	}
+	if err := p.applyListeners([]tListenerConfig{{Addr: addr}}); !errors.Is(err, errStopped) {
+		t.Errorf("expected applyListeners to fail with errStopped, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Secret config strings may be references resolved at load and reload:
+// file:/run/secrets/client_secret, env:NAME or exec:/usr/local/bin/helper arg...
+const secretExecTimeout = 10 * time.Second
+
+// isSecretRef reports whether s is a secret reference rather than a value
+func isSecretRef(s string) bool {
+	return strings.HasPrefix(s, "file:") || strings.HasPrefix(s, "env:") || strings.HasPrefix(s, "exec:")
+}
+
+// resolveSecretRefs replaces every secret reference in c with the value it points to
+func resolveSecretRefs(c *tConfig) error {
+	return forEachSecret(c, func(s string) (string, error) {
+		if !isSecretRef(s) {
+			return s, nil
+		}
+		v, err := resolveSecretRef(s)
+		if err != nil {
+			return "", fmt.Errorf("secret reference %s: %w", s, err)
+		}
+		return v, nil
+	})
+}
+
+func resolveSecretRef(ref string) (string, error) {
+	kind, arg, _ := strings.Cut(ref, ":")
+	switch kind {
+	case "file":
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case "env":
+		v, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", arg)
+		}
+		return v, nil
+	}
+	args := strings.Fields(arg)
+	if len(args) == 0 {
+		return "", fmt.Errorf("no command")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
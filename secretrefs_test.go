@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestResolveSecretRefs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client_secret")
+	os.WriteFile(path, []byte("from-file\n"), 0600)
+	t.Setenv("TEST_SMTP_PASS", "from-env")
+	c := &tConfig{
+		OAuth2Config:     tOAuth2Config{ClientSecret: "file:" + path, ClientID: "plain-id"},
+		FallbackSMTPpass: "env:TEST_SMTP_PASS",
+	}
+	if runtime.GOOS != "windows" {
+		c.Sendmail.Identity.Password = "exec:echo from-exec"
+	}
+	if err := resolveSecretRefs(c); err != nil {
+		t.Fatalf("resolveSecretRefs failed: %v", err)
+	}
+	if c.OAuth2Config.ClientSecret != "from-file" || c.OAuth2Config.ClientID != "plain-id" || c.FallbackSMTPpass != "from-env" {
+		t.Errorf("unexpected values %+v", c)
+	}
+	if runtime.GOOS != "windows" && c.Sendmail.Identity.Password != "from-exec" {
+		t.Errorf("expected value from command, got '%s'", c.Sendmail.Identity.Password)
+	}
+
+	for _, ref := range []string{"env:TEST_SMTP_UNSET", "file:/nonexistent/secret", "exec:/nonexistent/helper"} {
+		if err := resolveSecretRefs(&tConfig{FallbackSMTPpass: ref}); err == nil {
+			t.Errorf("expected error for %s", ref)
+		}
+	}
+}
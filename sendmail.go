@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tSendmailConfig holds the settings of the sendmail-compatible command line mode
+type tSendmailConfig struct {
+	RelayAddr string    `yaml:"relay_addr"` // host:port or unix:/path of the running relay; empty delivers directly
+	RelayCA   string    `yaml:"relay_ca"`   // PEM file trusted for the relay's STARTTLS certificate, in addition to the system roots
+	Identity  tIdentity `yaml:"identity"`
+}
+
+var (
+	errRelayNotEncrypted  = errors.New("relay offers no STARTTLS, refusing to send the password in plaintext")
+	errNoSendmailIdentity = errors.New("neither sendmail.relay_addr nor sendmail.identity is configured")
+)
+
+// Exit codes from sysexits.h
+const (
+	exOK          = 0
+	exUsage       = 64
+	exDataErr     = 65
+	exNoUser      = 67
+	exUnavailable = 69
+	exSoftware    = 70
+	exIOErr       = 74
+	exTempFail    = 75
+	exConfig      = 78
+)
+
+type sendmailOptions struct {
+	headerRecipients bool // -t
+	ignoreDots       bool // -i, -oi
+	from             string
+	recipients       []string
+	config           string // -config, like in service mode
+}
+
+// sendmailMode reports whether the binary was invoked as sendmail (argv[0] or -sendmail)
+// and returns the arguments to parse in that mode
+func sendmailMode(args []string) (bool, []string) {
+	name := strings.TrimSuffix(strings.ToLower(filepath.Base(args[0])), ".exe")
+	if name == "sendmail" {
+		return true, args[1:]
+	}
+	for i, a := range args[1:] {
+		if a == "-sendmail" || a == "--sendmail" {
+			return true, append(append([]string{}, args[1:i+1]...), args[i+2:]...)
+		}
+	}
+	return false, nil
+}
+
+// parseSendmailArgs parses the subset of sendmail options scripts use; other options are ignored
+func parseSendmailArgs(args []string) (sendmailOptions, error) {
+	var o sendmailOptions
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			o.recipients = append(o.recipients, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(a, "-") || a == "-" {
+			o.recipients = append(o.recipients, a)
+			continue
+		}
+		switch {
+		case a == "-config" || a == "--config":
+			if i+1 >= len(args) {
+				return o, fmt.Errorf("option %s requires a value", a)
+			}
+			i++
+			o.config = args[i]
+		case strings.HasPrefix(a, "-config=") || strings.HasPrefix(a, "--config="):
+			_, o.config, _ = strings.Cut(a, "=")
+		case a == "-t":
+			o.headerRecipients = true
+		case a == "-i" || a == "-oi":
+			o.ignoreDots = true
+		case strings.HasPrefix(a, "-o"), strings.HasPrefix(a, "-bm"):
+			// -odi, -oem, ... and the default "deliver mail" mode
+		case len(a) >= 2 && strings.ContainsRune("fFBNRVXr", rune(a[1])):
+			// options with a value, either attached (-fuser@domain) or as the next argument
+			value := a[2:]
+			if value == "" {
+				if i+1 >= len(args) {
+					return o, fmt.Errorf("option %s requires a value", a)
+				}
+				i++
+				value = args[i]
+			}
+			if a[1] == 'f' || a[1] == 'r' {
+				o.from = value
+			}
+		default:
+			return o, fmt.Errorf("unsupported option %s", a)
+		}
+	}
+	return o, nil
+}
+
+// readSendmailMessage reads the message from r; unless ignoreDots is set a line with a single dot ends it
+func readSendmailMessage(r io.Reader, ignoreDots bool) (string, error) {
+	if ignoreDots {
+		b, err := io.ReadAll(r)
+		return string(b), err
+	}
+	var sb strings.Builder
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == "." {
+			break
+		}
+		sb.WriteString(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return sb.String(), nil
+}
+
+// sendmailMain runs the sendmail-compatible mode with the parsed options and returns a sysexits exit code
+func sendmailMain(o sendmailOptions) int {
+	if logFile == os.Stdout {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	}
+	raw, err := readSendmailMessage(os.Stdin, o.ignoreDots)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: failed to read message: %v\n", err)
+		return exIOErr
+	}
+	raw = normalizeLineEndings(raw)
+	c := getConfig().Sendmail
+	from, headerRcpt, err := messageEnvelope(raw, c.Identity.Username)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		return exDataErr
+	}
+	if o.from != "" {
+		from = o.from
+	}
+	rcpt := o.recipients
+	if o.headerRecipients {
+		rcpt = append(rcpt, headerRcpt...)
+	}
+	if len(rcpt) == 0 {
+		fmt.Fprintf(os.Stderr, "sendmail: no recipients\n")
+		return exUsage
+	}
+	if c.RelayAddr != "" {
+		err = sendmailRelay(c, from, rcpt, raw)
+	} else {
+		err = sendmailDirect(c, from, rcpt, raw)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		return sendmailExitCode(err)
+	}
+	return exOK
+}
+
+// sendmailDirect delivers the message through Graph with the configured identity
+func sendmailDirect(c tSendmailConfig, from string, rcpt []string, raw string) error {
+	if c.Identity.Username == "" {
+		return fmt.Errorf("%w in %s", errNoSendmailIdentity, configFile)
+	}
+	m := &tMessage{ID: newMessageID(), Source: "sendmail", Username: c.Identity.Username, Password: c.Identity.Password, MailFrom: from, RcptTo: rcpt}
+	ctx := context.Background()
+	if err := parseMessage(ctx, m, raw); err != nil {
+		return err
+	}
+	if err := checkMessagePolicy(m); err != nil {
+		return err
+	}
+	return deliverMessage(ctx, m)
+}
+
+// sendmailRelay hands the message to the running relay over SMTP (TCP or Unix socket)
+func sendmailRelay(c tSendmailConfig, from string, rcpt []string, raw string) error {
+	network, addr := "tcp", c.RelayAddr
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", addr[len("unix:"):]
+	}
+	conn, err := net.DialTimeout(network, addr, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Minute))
+	client, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	host, _, _ := net.SplitHostPort(addr)
+	if ok, _ := client.Extension("STARTTLS"); ok && network == "tcp" {
+		tlsConfig := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		if c.RelayCA != "" {
+			if tlsConfig.RootCAs, err = loadCABundle(c.RelayCA); err != nil {
+				return err
+			}
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if c.Identity.Username != "" {
+		if _, encrypted := client.TLSConnectionState(); !encrypted && network == "tcp" && !isLoopbackHost(host) {
+			return fmt.Errorf("%s: %w", c.RelayAddr, errRelayNotEncrypted)
+		}
+		if err := client.Auth(loginAuth{c.Identity.Username, c.Identity.Password}); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, r := range rcpt {
+		if err := client.Rcpt(r); err != nil {
+			return fmt.Errorf("recipient %s: %w", r, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// sendmailExitCode maps a relay or delivery error to a sysexits code
+func sendmailExitCode(err error) int {
+	reply := ""
+	var de *deliveryError
+	var te *textproto.Error
+	switch {
+	case errors.As(err, &de):
+		reply = de.Reply
+	case errors.As(err, &te):
+		reply = fmt.Sprintf("%d", te.Code)
+	case errors.Is(err, errRelayNotEncrypted), errors.Is(err, errNoSendmailIdentity):
+		return exConfig
+	default:
+		return exTempFail // connection failures
+	}
+	switch {
+	case strings.HasPrefix(reply, "4"):
+		return exTempFail
+	case strings.HasPrefix(reply, "550 5.6"):
+		return exDataErr
+	case strings.HasPrefix(reply, "55") && strings.Contains(err.Error(), "recipient"):
+		return exNoUser
+	case strings.HasPrefix(reply, "5"):
+		return exUnavailable
+	}
+	return exSoftware
+}
+
+// loginAuth implements smtp.Auth for AUTH LOGIN, the relay's default mechanism
+type loginAuth struct {
+	username, password string
+}
+
+func (a loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSendmailMode(t *testing.T) {
+	if ok, args := sendmailMode([]string{"/usr/sbin/sendmail", "-t", "-i"}); !ok || !reflect.DeepEqual(args, []string{"-t", "-i"}) {
+		t.Errorf("expected sendmail mode from argv[0], got %v %v", ok, args)
+	}
+	if ok, args := sendmailMode([]string{"azureSMTPwithOAuth", "-sendmail", "-t", "you@example.com"}); !ok || !reflect.DeepEqual(args, []string{"-t", "you@example.com"}) {
+		t.Errorf("expected sendmail mode from -sendmail, got %v %v", ok, args)
+	}
+	if ok, _ := sendmailMode([]string{"azureSMTPwithOAuth", "-service", "start"}); ok {
+		t.Errorf("expected normal mode")
+	}
+}
+
+func TestParseSendmailArgs(t *testing.T) {
+	o, err := parseSendmailArgs([]string{"-t", "-oi", "-odi", "-f", "app@domain.com", "-F", "App", "a@example.com", "--", "-b@example.com"})
+	if err != nil {
+		t.Fatalf("parseSendmailArgs failed: %v", err)
+	}
+	if !o.headerRecipients || !o.ignoreDots || o.from != "app@domain.com" {
+		t.Errorf("unexpected options %+v", o)
+	}
+	if !reflect.DeepEqual(o.recipients, []string{"a@example.com", "-b@example.com"}) {
+		t.Errorf("unexpected recipients %v", o.recipients)
+	}
+	if o, _ := parseSendmailArgs([]string{"-fapp@domain.com"}); o.from != "app@domain.com" {
+		t.Errorf("expected attached -f value, got '%s'", o.from)
+	}
+	if o, _ := parseSendmailArgs([]string{"-config", "/etc/relay.yaml", "-t"}); o.config != "/etc/relay.yaml" || !o.headerRecipients {
+		t.Errorf("expected -config to be parsed in sendmail mode, got %+v", o)
+	}
+	if o, _ := parseSendmailArgs([]string{"--config=/etc/relay.yaml"}); o.config != "/etc/relay.yaml" {
+		t.Errorf("expected --config=path to be parsed, got '%s'", o.config)
+	}
+	if _, err := parseSendmailArgs([]string{"-q"}); err == nil {
+		t.Errorf("expected error for unsupported option")
+	}
+}
+
+func TestReadSendmailMessage(t *testing.T) {
+	input := "Subject: Hi\n\nline\n.\nafter dot\n"
+	if msg, _ := readSendmailMessage(strings.NewReader(input), false); msg != "Subject: Hi\n\nline\n" {
+		t.Errorf("expected message to end at the dot line, got %q", msg)
+	}
+	if msg, _ := readSendmailMessage(strings.NewReader(input), true); msg != input {
+		t.Errorf("expected whole input with -i, got %q", msg)
+	}
+}
+
+func TestSendmailRelay_RejectedRecipient(t *testing.T) {
+	setConfig(&tConfig{RecipientPolicy: tRecipientPolicy{BlockedDomains: []string{"spam.com"}}})
+	l := testListener(t, tListenerConfig{DefaultIdentity: tIdentity{Username: "app@domain.com", Password: "secret"}})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			handleSMTPConnection(conn, l)
+		}
+	}()
+	err = sendmailRelay(tSendmailConfig{RelayAddr: ln.Addr().String()}, "app@domain.com", []string{"you@spam.com"}, "Subject: Hi\r\n\r\nBody\r\n")
+	if err == nil {
+		t.Fatalf("expected relay to reject the recipient")
+	}
+	if code := sendmailExitCode(err); code != exNoUser {
+		t.Errorf("expected EX_NOUSER (%d), got %d (%v)", exNoUser, code, err)
+	}
+}
+
+func TestSendmailRelay_StartTLSBeforeAuth(t *testing.T) {
+	fakeTokenEndpoint(t, 0)
+	setConfig(&tConfig{OAuth2Config: tOAuth2Config{TenantID: "contoso.onmicrosoft.com"}, RecipientPolicy: tRecipientPolicy{BlockedDomains: []string{"spam.com"}}})
+	certFile, keyFile := testCertificate(t)
+	// A starttls listener refuses AUTH before the handshake
+	l := testListener(t, tListenerConfig{TLS: tlsModeStartTLS, TLSCert: certFile, TLSKey: keyFile})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			handleSMTPConnection(conn, l)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	c := tSendmailConfig{RelayAddr: "localhost:" + port, RelayCA: certFile, Identity: tIdentity{Username: "app@domain.com", Password: "good"}}
+	err = sendmailRelay(c, "app@domain.com", []string{"you@spam.com"}, "Subject: Hi\r\n\r\nBody\r\n")
+	if code := sendmailExitCode(err); code != exNoUser {
+		t.Errorf("expected to authenticate over STARTTLS and reach RCPT (EX_NOUSER), got %d (%v)", code, err)
+	}
+}
+
+func TestSendmailDirect_NoIdentity(t *testing.T) {
+	// Callers drop mail on EX_UNAVAILABLE, a missing config must make them retry or report it instead
+	err := sendmailDirect(tSendmailConfig{}, "app@domain.com", []string{"you@example.com"}, "Subject: Hi\r\n\r\nBody\r\n")
+	if code := sendmailExitCode(err); code != exConfig {
+		t.Errorf("expected EX_CONFIG (%d) without an identity, got %d (%v)", exConfig, code, err)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+// tTimeoutsConfig holds the per-command and DATA timeouts (RFC 5321 section 4.5.3.2) and the deadlines
+// of the delivery stages
+type tTimeoutsConfig struct {
+	Command time.Duration `yaml:"command"`
+	Data    time.Duration `yaml:"data"`
+	Token   time.Duration `yaml:"token"` // token acquisition, at AUTH and before delivery
+	MIME    time.Duration `yaml:"mime"`  // parsing the message
+	Graph   time.Duration `yaml:"graph"` // Graph sendMail call
+}
+
+const (
+	defaultCommandTimeout  = 5 * time.Minute
+	defaultDataTimeout     = 3 * time.Minute
+	defaultDrainTimeout    = 15 * time.Second
+	maxWindowsDrainTimeout = 15 * time.Second // Windows kills a service that hasn't stopped after 20s
+	defaultTokenTimeout    = 30 * time.Second
+	defaultMIMETimeout     = time.Minute
+	defaultGraphTimeout    = 5 * time.Minute
+)
+
+// Line limits of RFC 5321 section 4.5.3.1 including CRLF; AUTH lines may be longer (RFC 4954 section 4)
+const (
+	maxCommandLine        = 512
+	maxAuthLine           = 12288
+	maxTextLine           = 1000
+	defaultMaxMessageSize = 25 << 20
+)
+
+// drainWindow returns the drain window of c, capped when running as a Windows service
+func drainWindow(c *tConfig) time.Duration {
+	d := durationOrDefault(c.DrainTimeout, defaultDrainTimeout)
+	if service.Platform() == "windows-service" {
+		return min(d, maxWindowsDrainTimeout)
+	}
+	return d
+}
+
+// maxMessageSize returns the largest message accepted, in bytes
+func maxMessageSize(c *tConfig) int64 {
+	if c.MaxMessageSize > 0 {
+		return c.MaxMessageSize
+	}
+	return defaultMaxMessageSize
+}
+
+var (
+	errLineTooLong        = errors.New("line too long")
+	errClientDisconnected = errors.New("client disconnected")
+	errShuttingDown       = errors.New("service shutting down")
+)
+
+// tSessionLimiter limits the number of concurrent sessions globally and per client IP (thread-safe)
+type tSessionLimiter struct {
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+var sessionLimiter = newSessionLimiter()
+
+func newSessionLimiter() *tSessionLimiter {
+	return &tSessionLimiter{perIP: make(map[string]int)}
+}
+
+// acquire reserves a session slot for ip. Zero limits mean unlimited.
+func (l *tSessionLimiter) acquire(ip string, maxTotal, maxPerIP int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if maxTotal > 0 && l.total >= maxTotal {
+		return false
+	}
+	if maxPerIP > 0 && l.perIP[ip] >= maxPerIP {
+		return false
+	}
+	l.total++
+	l.perIP[ip]++
+	return true
+}
+
+// release frees a slot reserved by acquire
+func (l *tSessionLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// draining is set when the service is stopping; sessions finish their current transaction and get 421
+var draining atomic.Bool
+
+// tSessionRegistry tracks the open sessions so they can be drained on shutdown (thread-safe)
+type tSessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[net.Conn]*atomic.Bool // value: session is in the middle of a transaction
+	wg       sync.WaitGroup
+	draining bool            // no sessions are added once set, so wg.Add never races with wait
+	ctx      context.Context // parent of the session contexts, cancelled by closeAll
+	cancel   context.CancelCauseFunc
+}
+
+var activeSessions = newSessionRegistry()
+
+func newSessionRegistry() *tSessionRegistry {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &tSessionRegistry{sessions: make(map[net.Conn]*atomic.Bool), ctx: ctx, cancel: cancel}
+}
+
+// baseContext returns the parent context of new sessions; it is cancelled when the sessions are force-closed
+func (r *tSessionRegistry) baseContext() context.Context {
+	return r.ctx
+}
+
+// add registers a session and returns its busy flag, or false once the registry is draining
+func (r *tSessionRegistry) add(conn net.Conn) (*atomic.Bool, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining {
+		return nil, false
+	}
+	busy := new(atomic.Bool)
+	r.sessions[conn] = busy
+	r.wg.Add(1)
+	return busy, true
+}
+
+func (r *tSessionRegistry) remove(conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sessions[conn]; ok {
+		delete(r.sessions, conn)
+		r.wg.Done()
+	}
+}
+
+// drain refuses new sessions and wakes up sessions waiting for a command so they can reply 421 and close
+func (r *tSessionRegistry) drain() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.draining = true
+	for conn, busy := range r.sessions {
+		if !busy.Load() {
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+}
+
+// closeAll force-closes every remaining session and cancels their token and Graph calls
+func (r *tSessionRegistry) closeAll() {
+	r.cancel(errShuttingDown)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for conn := range r.sessions {
+		conn.Close()
+	}
+}
+
+// wait blocks until all sessions ended or timeout expired; it reports whether all sessions ended
+func (r *tSessionRegistry) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// deadlineWriter sets a write deadline of timeout before every write to conn
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.conn.Write(p)
+}
+
+// isTimeout reports whether err is a read deadline expiry
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// watchDisconnect cancels the session while it is not reading from the client, e.g. during delivery,
+// if the client hangs up. stop ends the watch; input sent meanwhile stays in reader.
+func watchDisconnect(conn net.Conn, reader *bufio.Reader, cancel context.CancelCauseFunc) (stop func()) {
+	conn.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := reader.Peek(1); err != nil && !isTimeout(err) {
+			cancel(errClientDisconnected)
+		}
+	}()
+	return func() {
+		conn.SetReadDeadline(time.Now())
+		<-done
+	}
+}
+
+// stageContext limits a delivery stage to timeout, or def if timeout is not set
+func stageContext(ctx context.Context, timeout, def time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, durationOrDefault(timeout, def))
+}
+
+// interruptedReply returns the reply for a stage that timed out or was cancelled, "" for other errors
+func interruptedReply(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || isTimeout(err):
+		return "451 4.4.1 Delivery timed out, try again later"
+	case errors.Is(err, context.Canceled):
+		return "451 4.3.2 Delivery interrupted, try again later"
+	}
+	return ""
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionLimiter(t *testing.T) {
+	l := newSessionLimiter()
+	if !l.acquire("10.0.0.1", 3, 2) || !l.acquire("10.0.0.1", 3, 2) {
+		t.Fatalf("expected first two sessions to be accepted")
+	}
+	if l.acquire("10.0.0.1", 3, 2) {
+		t.Errorf("expected per-IP limit to reject the third session")
+	}
+	if !l.acquire("10.0.0.2", 3, 2) {
+		t.Fatalf("expected session from another IP to be accepted")
+	}
+	if l.acquire("10.0.0.3", 3, 2) {
+		t.Errorf("expected global limit to reject the session")
+	}
+	l.release("10.0.0.1")
+	if !l.acquire("10.0.0.1", 3, 2) {
+		t.Errorf("expected session to be accepted after release")
+	}
+}
+
+func TestHandleSMTPConnection_CommandTimeout(t *testing.T) {
+	setConfig(&tConfig{Timeouts: tTimeoutsConfig{Command: 50 * time.Millisecond}})
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleSMTPConnection(server, testListener(t, tListenerConfig{}))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(client)
+	if greeting, _ := reader.ReadString('\n'); !strings.HasPrefix(greeting, "220") {
+		t.Fatalf("expected 220 greeting, got '%s'", greeting)
+	}
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read timeout reply: %v", err)
+	}
+	if !strings.HasPrefix(reply, "421 4.4.2") {
+		t.Errorf("expected 421 4.4.2 on idle timeout, got '%s'", reply)
+	}
+}
+
+func TestHandleSMTPConnection_DrainIdleSession(t *testing.T) {
+	setConfig(&tConfig{})
+	saved := activeSessions
+	activeSessions = newSessionRegistry()
+	t.Cleanup(func() { activeSessions = saved })
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleSMTPConnection(server, testListener(t, tListenerConfig{}))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(client)
+	if greeting, _ := reader.ReadString('\n'); !strings.HasPrefix(greeting, "220") {
+		t.Fatalf("expected 220 greeting, got '%s'", greeting)
+	}
+	draining.Store(true)
+	defer draining.Store(false)
+	activeSessions.drain()
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read shutdown reply: %v", err)
+	}
+	if !strings.HasPrefix(reply, "421 4.3.2") {
+		t.Errorf("expected 421 4.3.2 on shutdown, got '%s'", reply)
+	}
+	if !activeSessions.wait(time.Second) {
+		t.Errorf("expected session to end after drain")
+	}
+	// Sessions that got past the listener's draining check are refused, not added during wait
+	late, server2 := net.Pipe()
+	defer late.Close()
+	go handleSMTPConnection(server2, testListener(t, tListenerConfig{}))
+	late.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if reply, _ := bufio.NewReader(late).ReadString('\n'); !strings.HasPrefix(reply, "421 4.3.2") {
+		t.Errorf("expected 421 4.3.2 for a session started while draining, got '%s'", reply)
+	}
+	if !activeSessions.wait(time.Second) {
+		t.Errorf("expected the refused session not to be registered")
+	}
+}
+
+func TestHandleSMTPConnection_DisconnectCancelsAuth(t *testing.T) {
+	fakeTokenEndpoint(t, 2*time.Second)
+	t.Cleanup(func() { // the token request outlives the session, don't let it leak into other tests
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			tokenFetches.Lock()
+			n := len(tokenFetches.m)
+			tokenFetches.Unlock()
+			if n == 0 {
+				return
+			}
+		}
+	})
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleSMTPConnection(server, testListener(t, tListenerConfig{AuthMechanisms: []string{"PLAIN"}}))
+		close(done)
+	}()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(client)
+	if greeting, _ := reader.ReadString('\n'); !strings.HasPrefix(greeting, "220") {
+		t.Fatalf("expected 220 greeting, got '%s'", greeting)
+	}
+	client.Write([]byte("AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00slow@domain.com\x00good")) + "\r\n"))
+	time.Sleep(100 * time.Millisecond) // token request in flight
+	start := time.Now()
+	client.Close()
+	select {
+	case <-done:
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("expected the session to end right after the disconnect, took %v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session did not end after the client disconnected")
+	}
+}
+
+func TestHandleSMTPConnection_SizeLimits(t *testing.T) {
+	setConfig(&tConfig{MaxMessageSize: 2000})
+	l := testListener(t, tListenerConfig{DefaultIdentity: tIdentity{Username: "app@domain.com", Password: "secret"}})
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleSMTPConnection(server, l)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	rw := bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
+	smtpExchange(t, rw, "")
+	rw.WriteString("EHLO test\r\n")
+	rw.Flush()
+	sawSize := false
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read EHLO reply: %v", err)
+		}
+		sawSize = sawSize || strings.HasPrefix(line, "250-SIZE 2000")
+		if strings.HasPrefix(line, "250 ") {
+			break
+		}
+	}
+	if !sawSize {
+		t.Errorf("expected SIZE 2000 in the EHLO reply")
+	}
+	if reply := smtpExchange(t, rw, "NOOP "+strings.Repeat("x", 600)); !strings.HasPrefix(reply, "500 5.5.2") {
+		t.Errorf("expected 500 5.5.2 for a long command line, got '%s'", reply)
+	}
+	if reply := smtpExchange(t, rw, "MAIL FROM:<app@domain.com> SIZE=5000"); !strings.HasPrefix(reply, "552 5.3.4") {
+		t.Errorf("expected 552 5.3.4 for a declared size over the limit, got '%s'", reply)
+	}
+	smtpExchange(t, rw, "MAIL FROM:<app@domain.com>")
+	smtpExchange(t, rw, "RCPT TO:<a@example.com>")
+	smtpExchange(t, rw, "DATA")
+	rw.WriteString("Subject: x\r\n\r\n" + strings.Repeat("y", 1200) + "\r\n.\r\n")
+	rw.Flush()
+	if reply := smtpExchange(t, rw, ""); !strings.HasPrefix(reply, "500 5.5.2") {
+		t.Errorf("expected 500 5.5.2 for a long text line, got '%s'", reply)
+	}
+	smtpExchange(t, rw, "MAIL FROM:<app@domain.com>")
+	smtpExchange(t, rw, "RCPT TO:<a@example.com>")
+	smtpExchange(t, rw, "DATA")
+	rw.WriteString("Subject: x\r\n\r\n" + strings.Repeat(strings.Repeat("z", 500)+"\r\n", 5) + ".\r\n")
+	rw.Flush()
+	if reply := smtpExchange(t, rw, ""); !strings.HasPrefix(reply, "552 5.3.4") {
+		t.Errorf("expected 552 5.3.4 for a message over max_message_size, got '%s'", reply)
+	}
+	if reply := smtpExchange(t, rw, "QUIT"); !strings.HasPrefix(reply, "221") {
+		t.Errorf("expected the session to stay usable, got '%s'", reply)
+	}
+}
+
+func TestHandleSMTPConnection_WriteTimeout(t *testing.T) {
+	setConfig(&tConfig{Timeouts: tTimeoutsConfig{Command: 100 * time.Millisecond}})
+	client, server := net.Pipe() // unbuffered: writes block until the client reads
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		handleSMTPConnection(server, testListener(t, tListenerConfig{}))
+		close(done)
+	}()
+	// The client pipelines commands and never reads a reply
+	go client.Write([]byte("NOOP\r\nNOOP\r\nNOOP\r\n"))
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Errorf("expected the session to end when the client doesn't read its replies")
+	}
+}
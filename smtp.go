@@ -3,15 +3,18 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/mail"
+	"net/url"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"mime"
@@ -19,36 +22,93 @@ import (
 	"mime/quotedprintable"
 
 	"net/http"
-
-	"golang.org/x/oauth2"
 )
 
-// TokenCache holds cached OAuth2 tokens per user (thread-safe)
-var TokenCache sync.Map
-
-type cachedToken struct {
-	token     string
-	expiresAt time.Time
-}
-
-func handleSMTPConnection(conn net.Conn) {
+func handleSMTPConnection(conn net.Conn, l *tListener) {
 	defer conn.Close()
+	cfg := getConfig() // a reload applies to new sessions
+	commandTimeout := durationOrDefault(cfg.Timeouts.Command, defaultCommandTimeout)
+	busy, ok := activeSessions.add(conn)
+	if !ok {
+		conn.SetWriteDeadline(time.Now().Add(commandTimeout))
+		fmt.Fprintf(conn, "421 4.3.2 Service shutting down\r\n")
+		return
+	}
+	defer activeSessions.remove(conn)
 	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-	fmt.Fprintf(writer, "220 SMTP Relay Ready\r\n")
+	// Replies are written with a deadline, a client that doesn't read them can't block the session
+	writer := bufio.NewWriter(deadlineWriter{conn, commandTimeout})
+	lmtp := l.Protocol == protocolLMTP
+	if lmtp {
+		fmt.Fprintf(writer, "220 LMTP Relay Ready\r\n")
+	} else {
+		fmt.Fprintf(writer, "220 SMTP Relay Ready\r\n")
+	}
 	writer.Flush()
 
+	// Cancelled when the client hangs up while waiting for a token or delivery, or when the service stops
+	ctx, cancel := context.WithCancelCause(activeSessions.baseContext())
+	defer cancel(nil)
+	clientIP := remoteIP(conn.RemoteAddr())
 	var username, password string
+	var cred []byte // set instead of password once a renewable token is cached for it
 	authenticated := false
+	tlsActive := l.TLS == tlsModeImplicit
+	// Local peers mapped by their Unix socket credentials, and legacy clients on listeners
+	// with a default identity, may send without AUTH
+	if ident, ok := l.peerIdentity(conn); ok {
+		username = ident.Username
+		password = ident.Password
+		authenticated = true
+	} else if !l.RequireAuth && l.DefaultIdentity.Username != "" {
+		username = l.DefaultIdentity.Username
+		password = l.DefaultIdentity.Password
+		authenticated = true
+	}
 	var mailFrom string
 	var rcptTo []string
 	var dataLines []string
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
+	// readLine reads one line of at most max bytes from the client with a read deadline of timeout
+	readLine := func(timeout time.Duration, max int) (string, error) {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		return readLimitedLine(reader, max)
+	}
+	dataTimeout := durationOrDefault(cfg.Timeouts.Data, defaultDataTimeout)
+	maxSize := maxMessageSize(cfg)
+	// closeOnReadError replies to a failed read and reports the error
+	closeOnReadError := func(err error) {
+		if draining.Load() {
+			logger.Info("Session closed: service shutting down", "ip", clientIP, "username", username)
+			fmt.Fprintf(writer, "421 4.3.2 Service shutting down\r\n")
+		} else if isTimeout(err) {
+			logger.Warn("Client timed out", "ip", clientIP, "username", username)
+			fmt.Fprintf(writer, "421 4.4.2 Connection timed out\r\n")
+		} else {
 			logger.Error("Client read error", "error", err)
 			fmt.Fprintf(writer, "421 4.7.0 Service not available\r\n")
+		}
+		writer.Flush()
+	}
+	for {
+		if err := writer.Flush(); err != nil { // a reply could not be sent in time
+			logger.Warn("Client write error", "ip", clientIP, "username", username, "error", err)
+			return
+		}
+		if draining.Load() && !busy.Load() {
+			closeOnReadError(nil)
+			return
+		}
+		line, err := readLine(commandTimeout, maxAuthLine)
+		if err == nil && len(line) > maxCommandLine && !strings.HasPrefix(strings.ToUpper(line), "AUTH") {
+			err = errLineTooLong
+		}
+		if errors.Is(err, errLineTooLong) {
+			fmt.Fprintf(writer, "500 5.5.2 Line too long\r\n")
 			writer.Flush()
+			continue
+		}
+		if err != nil {
+			closeOnReadError(err)
 			return
 		}
 		line = strings.TrimRight(line, "\r\n")
@@ -57,56 +117,184 @@ func handleSMTPConnection(conn net.Conn) {
 		}
 		// Log the received command
 		logger.Debug("Received SMTP command", "command", line)
-		// Handle EHLO/HELO commands
-		if strings.HasPrefix(strings.ToUpper(line), "EHLO") || strings.HasPrefix(strings.ToUpper(line), "HELO") {
-			fmt.Fprintf(writer, "250-smtpRelay\r\n250-AUTH LOGIN\r\n250 STARTTLS\r\n")
+		// Handle EHLO/HELO commands (LHLO in LMTP mode, RFC 2033)
+		isHello := strings.HasPrefix(strings.ToUpper(line), "EHLO") || strings.HasPrefix(strings.ToUpper(line), "HELO")
+		if lmtp && isHello {
+			fmt.Fprintf(writer, "500 5.5.1 Use LHLO in LMTP mode\r\n")
+			writer.Flush()
+			continue
+		}
+		if lmtp {
+			isHello = strings.HasPrefix(strings.ToUpper(line), "LHLO")
+		}
+		if isHello {
+			extensions := []string{"smtpRelay", fmt.Sprintf("SIZE %d", maxSize)}
+			if l.TLS == tlsModeStartTLS && !tlsActive {
+				extensions = append(extensions, "STARTTLS")
+			} else {
+				extensions = append(extensions, "AUTH "+strings.Join(l.AuthMechanisms, " "))
+			}
+			for i, ext := range extensions {
+				sep := "-"
+				if i == len(extensions)-1 {
+					sep = " "
+				}
+				fmt.Fprintf(writer, "250%s%s\r\n", sep, ext)
+			}
 			writer.Flush()
 			continue
 		}
-		if strings.HasPrefix(strings.ToUpper(line), "AUTH LOGIN") {
-			// Handle both: AUTH LOGIN (prompt for username) and AUTH LOGIN <base64-username>
+		if strings.ToUpper(line) == "STARTTLS" {
+			if l.TLS != tlsModeStartTLS || tlsActive {
+				fmt.Fprintf(writer, "502 5.5.1 STARTTLS not available\r\n")
+				writer.Flush()
+				continue
+			}
+			fmt.Fprintf(writer, "220 2.0.0 Ready to start TLS\r\n")
+			writer.Flush()
+			tlsConn := tls.Server(conn, l.tlsConfig)
+			tlsConn.SetDeadline(time.Now().Add(commandTimeout))
+			if err := tlsConn.Handshake(); err != nil {
+				logger.Warn("TLS handshake failed", "ip", clientIP, "error", err)
+				return
+			}
+			tlsConn.SetDeadline(time.Time{})
+			conn = tlsConn
+			reader = bufio.NewReader(conn)
+			writer = bufio.NewWriter(deadlineWriter{conn, commandTimeout})
+			tlsActive = true
+			// RFC 3207: forget everything learned before the handshake
+			if authenticated && l.DefaultIdentity.Username == "" {
+				username, password, cred = "", "", nil
+				authenticated = false
+			}
+			mailFrom = ""
+			rcptTo = nil
+			continue
+		}
+		if strings.HasPrefix(strings.ToUpper(line), "AUTH") {
 			parts := strings.Fields(line)
-			if len(parts) == 3 {
+			mechanism := ""
+			if len(parts) > 1 {
+				mechanism = strings.ToUpper(parts[1])
+			}
+			if l.TLS == tlsModeStartTLS && !tlsActive {
+				fmt.Fprintf(writer, "538 5.7.11 Encryption required for requested authentication mechanism\r\n")
+				writer.Flush()
+				continue
+			}
+			if !l.allowsMechanism(mechanism) {
+				fmt.Fprintf(writer, "504 5.5.4 Unrecognized authentication type\r\n")
+				writer.Flush()
+				continue
+			}
+			if key, until, locked := authGuard.locked(clientIP, ""); locked {
+				logger.Warn("Authentication rejected: locked out", "event", "auth_locked", "key", key, "locked_until", until)
+				fmt.Fprintf(writer, "421 4.7.0 Too many failed authentication attempts, try again later\r\n")
+				writer.Flush()
+				return
+			}
+			if mechanism == "PLAIN" {
+				// AUTH PLAIN <base64(authzid NUL authcid NUL passwd)> or AUTH PLAIN and the response on the next line
+				resp := ""
+				if len(parts) == 3 {
+					resp = parts[2]
+				} else {
+					fmt.Fprintf(writer, "334 \r\n")
+					writer.Flush()
+					resp, err = readLine(commandTimeout, maxAuthLine)
+					if err != nil {
+						closeOnReadError(err)
+						return
+					}
+				}
+				username, password = decodePlainAuth(strings.TrimSpace(resp))
+				logger.Debug("AUTH PLAIN username", "username", username)
+			} else if len(parts) == 3 {
+				// Handle both: AUTH LOGIN (prompt for username) and AUTH LOGIN <base64-username>
 				// AUTH LOGIN <base64-username>
 				userB64 := strings.TrimSpace(parts[2])
 				username = decodeBase64(userB64)
 				logger.Debug("AUTH LOGIN inline username", "username", username)
 				fmt.Fprintf(writer, "334 UGFzc3dvcmQ6\r\n") // 'Password:' base64
 				writer.Flush()
-				passB64, _ := reader.ReadString('\n')
+				passB64, err := readLine(commandTimeout, maxAuthLine)
+				if err != nil {
+					closeOnReadError(err)
+					return
+				}
 				passB64 = strings.TrimSpace(passB64)
 				password = decodeBase64(passB64)
 			} else {
 				// Standard flow: prompt for username
 				fmt.Fprintf(writer, "334 VXNlcm5hbWU6\r\n") // 'Username:' base64
 				writer.Flush()
-				userB64, _ := reader.ReadString('\n')
+				userB64, err := readLine(commandTimeout, maxAuthLine)
+				if err != nil {
+					closeOnReadError(err)
+					return
+				}
 				userB64 = strings.TrimSpace(userB64)
 				username = decodeBase64(userB64)
 				logger.Debug("AUTH LOGIN username", "username", username)
 				fmt.Fprintf(writer, "334 UGFzc3dvcmQ6\r\n") // 'Password:' base64
 				writer.Flush()
-				passB64, _ := reader.ReadString('\n')
+				passB64, err := readLine(commandTimeout, maxAuthLine)
+				if err != nil {
+					closeOnReadError(err)
+					return
+				}
 				passB64 = strings.TrimSpace(passB64)
 				password = decodeBase64(passB64)
 			}
 			if username == "" || password == "" {
-				// Use fallback credentials from config if not provided by client
-				if config.FallbackSMTPuser == "" || config.FallbackSMTPpass == "" {
+				// Use fallback credentials from config if not provided by client, never where AUTH is required
+				if l.RequireAuth || cfg.FallbackSMTPuser == "" || cfg.FallbackSMTPpass == "" {
 					fmt.Fprintf(writer, "535 5.7.8 Authentication credentials invalid\r\n")
 					writer.Flush()
 					logger.Error("Authentication failed: no credentials provided")
-					return
+					continue
 				}
-				username = config.FallbackSMTPuser
-				password = config.FallbackSMTPpass
+				username = cfg.FallbackSMTPuser
+				password = cfg.FallbackSMTPpass
+			}
+			if key, until, locked := authGuard.locked(clientIP, username); locked {
+				logger.Warn("Authentication rejected: locked out", "event", "auth_locked", "key", key, "username", username, "locked_until", until)
+				fmt.Fprintf(writer, "421 4.7.0 Too many failed authentication attempts, try again later\r\n")
+				writer.Flush()
+				return
 			}
 			// Validate username and password
-			_, err = getCachedOAuth2Token(context.Background(), username, password)
+			tctx, cancelToken := stageContext(ctx, cfg.Timeouts.Token, defaultTokenTimeout)
+			stopWatch := watchDisconnect(conn, reader, cancel)
+			_, err = getCachedOAuth2Token(tctx, l.Tenant, username, password)
+			stopWatch()
+			cancelToken()
+			if ctx.Err() != nil {
+				logger.Info("Session cancelled during authentication", "username", username, "ip", clientIP, "cause", context.Cause(ctx))
+				return
+			}
 			if err != nil {
-				logger.Error("OAuth2 token retrieval failed", "error", err)
+				class := classifyAuthError(err)
+				switch class {
+				case authErrCredentials:
+					logger.Warn("Authentication failed: invalid credentials", "username", username, "ip", clientIP, "error", err)
+					time.Sleep(authGuard.fail(cfg.AuthGuard, clientIP, username))
+				case authErrMFA:
+					logger.Warn("Authentication failed: MFA or Conditional Access required", "username", username, "ip", clientIP, "error", err)
+				default:
+					logger.Error("Authentication failed: token endpoint unavailable", "username", username, "ip", clientIP, "error", err)
+				}
+				fmt.Fprintf(writer, "%s\r\n", authFailureReply(class))
 				writer.Flush()
-				return
+				username, password, cred = "", "", nil
+				continue
+			}
+			authGuard.success(username)
+			// The refresh token renews the token from now on, don't keep the password for the whole session
+			cred = nil
+			if h := credHash(password); renewableWithoutPassword(l.Tenant, username, h) {
+				cred, password = h, ""
 			}
 			fmt.Fprintf(writer, "235 2.7.0 Authentication successful\r\n")
 			writer.Flush()
@@ -123,7 +311,13 @@ func handleSMTPConnection(conn net.Conn) {
 		}
 		// Handle MAIL FROM, RCPT TO, DATA commands
 		if strings.HasPrefix(strings.ToUpper(line), "MAIL FROM:") {
+			if size := mailSizeParam(line); size > maxSize {
+				fmt.Fprintf(writer, "552 5.3.4 Message size exceeds fixed maximum message size\r\n")
+				writer.Flush()
+				continue
+			}
 			mailFrom = extractAddress(line)
+			busy.Store(true)
 			fmt.Fprintf(writer, "250 2.1.0 Ok\r\n")
 			writer.Flush()
 			continue
@@ -131,6 +325,12 @@ func handleSMTPConnection(conn net.Conn) {
 		if strings.HasPrefix(strings.ToUpper(line), "RCPT TO:") {
 			addr := extractAddress(line)
 			if addr != "" {
+				if reply := checkRecipient(cfg.RecipientPolicy, username, addr, len(rcptTo)); reply != "" {
+					logger.Warn("Recipient rejected by policy", "username", username, "rcptTo", addr, "reply", reply)
+					fmt.Fprintf(writer, "%s\r\n", reply)
+					writer.Flush()
+					continue
+				}
 				rcptTo = append(rcptTo, addr)
 			}
 			fmt.Fprintf(writer, "250 2.1.5 Ok\r\n")
@@ -138,57 +338,98 @@ func handleSMTPConnection(conn net.Conn) {
 			continue
 		}
 		if strings.HasPrefix(strings.ToUpper(line), "DATA") {
+			if len(rcptTo) == 0 {
+				fmt.Fprintf(writer, "503 5.5.1 No valid recipients\r\n")
+				writer.Flush()
+				continue
+			}
+			if reason, ok := rateLimiter.allow(rateLimitKeys(cfg.RateLimits, username, clientIP, username), len(rcptTo)); !ok {
+				logger.Warn("Message rejected by rate limit", "username", username, "ip", clientIP, "rcptTo", rcptTo, "reason", reason)
+				fmt.Fprintf(writer, "451 4.7.1 Rate limit exceeded, try again later\r\n")
+				writer.Flush()
+				mailFrom = ""
+				rcptTo = nil
+				busy.Store(false)
+				continue
+			}
 			fmt.Fprintf(writer, "354 End data with <CR><LF>.<CR><LF>\r\n")
 			writer.Flush()
 			dataLines = nil
+			// Oversized messages and lines are read to the end so the session stays in sync, then rejected
+			var size int64
+			var dataReply string
 			for {
-				dataLine, err := reader.ReadString('\n')
+				dataLine, err := readLine(dataTimeout, maxTextLine)
+				if errors.Is(err, errLineTooLong) {
+					dataReply = "500 5.5.2 Line too long"
+					continue
+				}
 				if err != nil {
-					log.Printf("Client read error (DATA): %v", err)
+					closeOnReadError(err)
 					return
 				}
 				if strings.TrimSpace(dataLine) == "." {
 					break
 				}
-				dataLines = append(dataLines, dataLine)
+				// Remove dot-stuffing (RFC 5321 section 4.5.2)
+				dataLine = strings.TrimPrefix(dataLine, ".")
+				if size += int64(len(dataLine)); size > maxSize {
+					dataReply = "552 5.3.4 Message size exceeds fixed maximum message size"
+					dataLines = nil
+					continue
+				}
+				if dataReply == "" {
+					dataLines = append(dataLines, dataLine)
+				}
 			}
 
-			// Reconstruct message and normalize line endings for MIME parsing
-			msg := strings.Join(dataLines, "")
-			msg = strings.ReplaceAll(msg, "\r\n", "\n")
-			msg = strings.ReplaceAll(msg, "\r", "\n")
-			msg = strings.ReplaceAll(msg, "\n", "\r\n")
-
-			// Parse subject, body, and attachments
-			subject, body, isHTML, attachments, parseErr := parseSubjectBodyAndAttachments(msg)
-			if parseErr != nil {
-				fmt.Fprintf(writer, "550 5.6.0 Message parsing failed: %v\r\n", parseErr)
+			// replyData sends the result of the transaction; LMTP expects one reply per accepted recipient.
+			// Graph sendMail is all-or-nothing and reports no per-recipient status, so every recipient gets the same reply.
+			replyData := func(reply string) {
+				if !lmtp {
+					fmt.Fprintf(writer, "%s\r\n", reply)
+				} else {
+					for range rcptTo {
+						fmt.Fprintf(writer, "%s\r\n", reply)
+					}
+				}
 				writer.Flush()
-				logger.Error("MIME parsing failed", "error", parseErr)
+			}
+			if dataReply != "" {
+				logger.Warn("Message rejected", "username", username, "ip", clientIP, "size", size, "reply", dataReply)
+				replyData(dataReply)
+				mailFrom = ""
+				rcptTo = nil
+				dataLines = nil
+				busy.Store(false)
+				continue
+			}
+			source := protocolSMTP
+			if lmtp {
+				source = protocolLMTP
+			}
+			m := &tMessage{ID: newMessageID(), Source: source, Username: username, Password: password, Cred: cred, Tenant: l.Tenant, ClientIP: clientIP, MailFrom: mailFrom, RcptTo: rcptTo}
+			stopWatch := watchDisconnect(conn, reader, cancel)
+			// Parse subject, body, and attachments
+			if err := parseMessage(ctx, m, strings.Join(dataLines, "")); err != nil {
+				stopWatch()
+				replyData(err.(*deliveryError).Reply)
+				logger.Error("MIME parsing failed", "id", m.ID, "error", err)
 				return
 			}
-
 			// Get OAuth2 token and send via Graph API
-			token, err := getCachedOAuth2Token(context.Background(), username, password)
+			err := deliverMessage(ctx, m)
+			stopWatch()
 			if err != nil {
-				fmt.Fprintf(writer, "451 4.7.0 Temporary authentication failure\r\n")
-				writer.Flush()
-				logger.Error("Failed to get OAuth2 token", "error", err, "username", username)
+				replyData(err.(*deliveryError).Reply)
 				return
 			}
-			if err := sendMailGraphAPI(token, username, mailFrom, rcptTo, subject, body, isHTML, attachments); err != nil {
-				fmt.Fprintf(writer, "550 5.7.0 Delivery failed: %v\r\n", err)
-				writer.Flush()
-				logger.Error("Failed to send email via Graph API", "error", err, "username", username, "mailFrom", mailFrom, "rcptTo", rcptTo)
-				return
-			}
-			fmt.Fprintf(writer, "250 2.0.0 Ok: queued as graphapi\r\n")
-			writer.Flush()
+			replyData("250 2.0.0 Ok: queued as " + m.ID)
 			// Reset for next message
-			logger.Info("E-mail sent successfully", "username", username, "mailFrom", mailFrom, "rcptTo", rcptTo, "subject", subject)
 			mailFrom = ""
 			rcptTo = nil
 			dataLines = nil
+			busy.Store(false)
 			continue
 		}
 		if strings.HasPrefix(strings.ToUpper(line), "QUIT") {
@@ -202,6 +443,47 @@ func handleSMTPConnection(conn net.Conn) {
 	}
 }
 
+// readLimitedLine reads one line of at most max bytes including the line ending. A longer line is consumed
+// to its end and errLineTooLong returned.
+func readLimitedLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong && len(line)+len(chunk) > max {
+			tooLong = true
+			line = nil
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return string(line), err
+		}
+		if tooLong {
+			return "", errLineTooLong
+		}
+		return string(line), nil
+	}
+}
+
+// mailSizeParam returns the SIZE parameter of a MAIL FROM command (RFC 1870), 0 if missing
+func mailSizeParam(line string) int64 {
+	if i := strings.Index(line, ">"); i != -1 {
+		line = line[i+1:]
+	}
+	for _, p := range strings.Fields(line) {
+		if k, v, ok := strings.Cut(p, "="); ok && strings.EqualFold(k, "SIZE") {
+			size, _ := strconv.ParseInt(v, 10, 64)
+			return size
+		}
+	}
+	return 0
+}
+
 // extractAddress extracts the email address from SMTP command line
 func extractAddress(line string) string {
 	start := strings.Index(line, "<")
@@ -225,8 +507,9 @@ type Attachment struct {
 	Content     string // base64-encoded
 }
 
-// parseSubjectBodyAndAttachments parses the subject, body, and attachments from a raw SMTP message
-func parseSubjectBodyAndAttachments(msg string) (subject, body string, isHTML bool, attachments []Attachment, err error) {
+// parseSubjectBodyAndAttachments parses the subject, body, and attachments from a raw SMTP message;
+// it stops between parts once ctx is done
+func parseSubjectBodyAndAttachments(ctx context.Context, msg string) (subject, body string, isHTML bool, attachments []Attachment, err error) {
 	// Ensure message ends with a newline for robust parsing
 	if !strings.HasSuffix(msg, "\n") {
 		msg += "\n"
@@ -252,6 +535,9 @@ func parseSubjectBodyAndAttachments(msg string) (subject, body string, isHTML bo
 	if err == nil && strings.HasPrefix(mediaType, "multipart/") {
 		mr := multipart.NewReader(m.Body, params["boundary"])
 		for {
+			if err := ctx.Err(); err != nil {
+				return "", "", false, nil, err
+			}
 			p, err := mr.NextPart()
 			if err == io.EOF {
 				break
@@ -331,20 +617,17 @@ func decodeMessage(c string, r io.Reader) (content []byte, err error) {
 	return content, nil
 }
 
+// graphSendMailURLFormat is the Graph sendMail endpoint, %s is the sending mailbox
+var graphSendMailURLFormat = "https://microsoftgraph.chinacloudapi.cn/v1.0/users/%s/sendMail"
+
 // sendMailGraphAPI sends the email via Microsoft Graph API /sendMail
-func sendMailGraphAPI(token, sender, mailFrom string, rcptTo []string, subject, body string, isHTML bool, attachments []Attachment) error {
-	url := "https://microsoftgraph.chinacloudapi.cn/v1.0/users/" + sender + "/sendMail"
+func sendMailGraphAPI(ctx context.Context, token, sender, mailFrom string, to, cc, bcc []string, subject, body string, isHTML bool, attachments []Attachment) error {
+	url := fmt.Sprintf(graphSendMailURLFormat, sender)
 	contentType := "html"
 	// contentType := "text"
 	// if isHTML {
 	// 	contentType = "html"
 	// }
-	var toRecipients []map[string]map[string]string
-	for _, addr := range rcptTo {
-		toRecipients = append(toRecipients, map[string]map[string]string{
-			"emailAddress": {"address": addr},
-		})
-	}
 	var graphAttachments []map[string]interface{}
 	for _, att := range attachments {
 		graphAttachments = append(graphAttachments, map[string]interface{}{
@@ -364,34 +647,70 @@ func sendMailGraphAPI(token, sender, mailFrom string, rcptTo []string, subject,
 				"contentType": contentType,
 				"content":     body,
 			},
-			"toRecipients": toRecipients,
+			"toRecipients":  graphRecipients(to),
+			"ccRecipients":  graphRecipients(cc),
+			"bccRecipients": graphRecipients(bcc),
 			"from": map[string]map[string]string{
 				"emailAddress": {"address": mailFrom},
 			},
 			"attachments": graphAttachments,
 		},
-		"saveToSentItems": config.SaveToSent,
+		"saveToSentItems": getConfig().SaveToSent,
 	}
 	jsonBody, _ := json.Marshal(msg)
-	request, err := http.NewRequest("POST", url, strings.NewReader(string(jsonBody)))
+	request, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(string(jsonBody)))
 	if err != nil {
 		return err
 	}
 	request.Header.Set("Authorization", "Bearer "+token)
 	request.Header.Set("Content-Type", "application/json")
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(request)
+	resp, err := httpClient().Do(request)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 300 {
 		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("Graph API error: %s", string(b))
+		return &graphError{Status: resp.StatusCode, Body: string(b)}
 	}
 	return nil
 }
 
+// graphRecipients returns the Graph recipient list of addrs, empty rather than null
+func graphRecipients(addrs []string) []map[string]map[string]string {
+	recipients := make([]map[string]map[string]string, 0, len(addrs))
+	for _, addr := range addrs {
+		recipients = append(recipients, map[string]map[string]string{
+			"emailAddress": {"address": addr},
+		})
+	}
+	return recipients
+}
+
+// graphError is a sendMail call answered with an error status
+type graphError struct {
+	Status int
+	Body   string
+}
+
+func (e *graphError) Error() string {
+	return fmt.Sprintf("Graph API error: %d %s", e.Status, e.Body)
+}
+
+// temporary reports whether Graph throttled the request or failed on its side
+func (e *graphError) temporary() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+// decodePlainAuth decodes an AUTH PLAIN response (RFC 4616) into username and password
+func decodePlainAuth(s string) (string, string) {
+	parts := strings.Split(decodeBase64(s), "\x00")
+	if len(parts) != 3 {
+		return "", ""
+	}
+	return parts[1], parts[2]
+}
+
 func decodeBase64(s string) string {
 	b, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
@@ -400,59 +719,89 @@ func decodeBase64(s string) string {
 	return string(b)
 }
 
-// getCachedOAuth2Token returns a cached token or fetches a new one if expired
-func getCachedOAuth2Token(ctx context.Context, username, password string) (string, error) {
-	if val, ok := TokenCache.Load(username); ok {
-		tok := val.(cachedToken)
-		if time.Now().Before(tok.expiresAt) {
-			logger.Debug("Using cached OAuth2 token", "username", username, "expires_at", tok.expiresAt)
-			return tok.token, nil
-		}
-	}
-	token, expiresIn, err := getOAuth2TokenWithExpiry(ctx, username, password)
-	if err != nil {
-		return "", err
-	}
-	TokenCache.Store(username, cachedToken{
-		token:     token,
-		expiresAt: time.Now().Add(time.Duration(expiresIn-60) * time.Second), // refresh 1 min before expiry
-	})
-	logger.Debug("New OAuth2 token cached", "username", username, "expires_in", expiresIn)
-	return token, nil
+// tokenURLFormat is the token endpoint, %s is the tenant
+var tokenURLFormat = "https://login.partner.microsoftonline.cn/%s/oauth2/v2.0/token"
+
+// tokenResponse is a successful answer of the token endpoint
+type tokenResponse struct {
+	AccessToken  string
+	RefreshToken string // issued because offline_access is requested
+	ExpiresIn    int    // seconds
 }
 
-// getOAuth2TokenWithExpiry returns token and expiry (in seconds)
-func getOAuth2TokenWithExpiry(ctx context.Context, username, password string) (string, int, error) {
-	tokenURL := fmt.Sprintf("https://login.partner.microsoftonline.cn/%s/oauth2/v2.0/token", config.OAuth2Config.TenantID)
+// getOAuth2TokenWithExpiry gets a token for the user's password (ROPC) from the tenant of oc
+func getOAuth2TokenWithExpiry(ctx context.Context, oc tOAuth2Config, username, password string) (tokenResponse, error) {
 	params := make(map[string][]string)
-	params["client_id"] = []string{config.OAuth2Config.ClientID}
-	params["scope"] = []string{strings.Join(config.OAuth2Config.Scopes, " ")}
 	params["username"] = []string{username}
 	params["password"] = []string{password}
 	params["grant_type"] = []string{"password"}
-	params["client_secret"] = []string{config.OAuth2Config.ClientSecret}
+	return requestOAuth2Token(ctx, oc, params, username)
+}
+
+// refreshOAuth2Token renews a token with a refresh token, without the user's password
+func refreshOAuth2Token(ctx context.Context, oc tOAuth2Config, refreshToken, username string) (tokenResponse, error) {
+	params := make(map[string][]string)
+	params["refresh_token"] = []string{refreshToken}
+	params["grant_type"] = []string{"refresh_token"}
+	return requestOAuth2Token(ctx, oc, params, username)
+}
+
+// requestOAuth2Token posts a token request with the app credentials of oc added to params
+func requestOAuth2Token(ctx context.Context, oc tOAuth2Config, params map[string][]string, username string) (tokenResponse, error) {
+	tokenURL := fmt.Sprintf(tokenURLFormat, oc.TenantID)
+	params["client_id"] = []string{oc.ClientID}
+	params["scope"] = []string{offlineScopes(oc.Scopes)}
+	params["client_secret"] = []string{oc.ClientSecret}
 
-	resp, err := oauth2.NewClient(ctx, nil).PostForm(tokenURL, params)
+	request, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(url.Values(params).Encode()))
 	if err != nil {
-		return "", 0, err
+		return tokenResponse{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClient().Do(request)
+	if err != nil {
+		return tokenResponse{}, err
 	}
 	defer resp.Body.Close()
 	var result struct {
-		AccessToken string `json:"access_token"`
-		ExpiresIn   int    `json:"expires_in"`
+		AccessToken      string `json:"access_token"`
+		RefreshToken     string `json:"refresh_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+		ErrorCodes       []int  `json:"error_codes"`
 	}
-	// Debug: print the raw response body for troubleshooting
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", 0, fmt.Errorf("failed to read token response: %v", err)
+		return tokenResponse{}, fmt.Errorf("failed to read token response: %v", err)
 	}
 	if err := json.Unmarshal(body, &result); err != nil {
-		return "", 0, fmt.Errorf("failed to parse token response: %v, body: %s", err, string(body))
+		if resp.StatusCode >= 400 {
+			return tokenResponse{}, &tokenError{StatusCode: resp.StatusCode, Description: string(body)}
+		}
+		return tokenResponse{}, fmt.Errorf("failed to parse token response: %v, body: %s", err, string(body))
+	}
+	if result.Error != "" {
+		te := &tokenError{StatusCode: resp.StatusCode, ErrorCode: result.Error, Description: result.ErrorDescription}
+		if len(result.ErrorCodes) > 0 {
+			te.AADSTS = result.ErrorCodes[0]
+		}
+		return tokenResponse{}, te
 	}
 	// Check if access token is present
 	if result.AccessToken == "" {
-		return "", 0, fmt.Errorf("no access token in response, body: %s", string(body))
+		return tokenResponse{}, fmt.Errorf("no access token in response, body: %s", string(body))
+	}
+	logger.Debug("OAuth2 token retrieved", "username", username, "grant_type", params["grant_type"][0], "expires_in", result.ExpiresIn, "refresh_token", result.RefreshToken != "")
+	return tokenResponse{AccessToken: result.AccessToken, RefreshToken: result.RefreshToken, ExpiresIn: result.ExpiresIn}, nil
+}
+
+// offlineScopes returns the scope parameter with offline_access added, so a refresh token is issued
+func offlineScopes(scopes []string) string {
+	for _, s := range scopes {
+		if strings.EqualFold(s, "offline_access") {
+			return strings.Join(scopes, " ")
+		}
 	}
-	logger.Debug("OAuth2 token retrieved", "username", username, "expires_in", result.ExpiresIn)
-	return result.AccessToken, result.ExpiresIn, nil
+	return strings.Join(append(append([]string{}, scopes...), "offline_access"), " ")
 }
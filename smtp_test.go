@@ -2,12 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"io"
+	"log/slog"
 	"mime/multipart"
+	"os"
 	"strings"
 	"testing"
 )
 
+func TestMain(m *testing.M) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	os.Exit(m.Run())
+}
+
 func TestDecodeMessage_Base64(t *testing.T) {
 	input := base64.StdEncoding.EncodeToString([]byte("hello world"))
 	decoded, err := decodeMessage("base64", strings.NewReader(input))
@@ -43,7 +52,7 @@ func TestDecodeMessage_Default(t *testing.T) {
 
 func TestParseSubjectBodyAndAttachments_Simple(t *testing.T) {
 	raw := "From: test@example.com\r\nTo: you@example.com\r\nSubject: Hello\r\n\r\nThis is the body."
-	subject, body, isHTML, attachments, err := parseSubjectBodyAndAttachments(raw)
+	subject, body, isHTML, attachments, err := parseSubjectBodyAndAttachments(context.Background(), raw)
 	if err != nil {
 		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
 	}
@@ -65,7 +74,7 @@ func TestParseSubjectBodyAndAttachments_Simple(t *testing.T) {
 
 func TestParseSubjectBodyAndAttachments_SimpleHTML(t *testing.T) {
 	raw := "From: test@example.com\r\nTo: you@example.com\r\nSubject: Hello\r\nContent-Type: text/html\r\n\r\n<html><body>Hi!</body></html>"
-	subject, body, isHTML, attachments, err := parseSubjectBodyAndAttachments(raw)
+	subject, body, isHTML, attachments, err := parseSubjectBodyAndAttachments(context.Background(), raw)
 	if err != nil {
 		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
 	}
@@ -104,7 +113,7 @@ func TestParseSubjectBodyAndAttachments_MultipartWithAttachment(t *testing.T) {
 	attPart.Write([]byte(attContent))
 	w.Close()
 	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: Multipart\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"" + boundary + "\"\r\n\r\n" + buf.String()
-	subject, body, isHTML, attachments, err := parseSubjectBodyAndAttachments(msg)
+	subject, body, isHTML, attachments, err := parseSubjectBodyAndAttachments(context.Background(), msg)
 	if err != nil {
 		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
 	}
@@ -141,7 +150,7 @@ func TestParseSubjectBodyAndAttachments_MultipartHTMLBody(t *testing.T) {
 	bodyPart.Write([]byte("<b>HTML Body</b>"))
 	w.Close()
 	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: HTMLMultipart\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n\r\n" + buf.String()
-	subject, body, isHTML, attachments, err := parseSubjectBodyAndAttachments(msg)
+	subject, body, isHTML, attachments, err := parseSubjectBodyAndAttachments(context.Background(), msg)
 	if err != nil {
 		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
 	}
@@ -173,7 +182,7 @@ func TestParseSubjectBodyAndAttachments_MultipartNoBody(t *testing.T) {
 	attPart.Write([]byte(attContent))
 	w.Close()
 	msg := "From: test@example.com\r\nTo: you@example.com\r\nSubject: OnlyAttachment\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"" + boundary + "\"\r\n\r\n" + buf.String()
-	subject, body, isHTML, attachments, err := parseSubjectBodyAndAttachments(msg)
+	subject, body, isHTML, attachments, err := parseSubjectBodyAndAttachments(context.Background(), msg)
 	if err != nil {
 		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
 	}
@@ -200,7 +209,7 @@ func TestParseSubjectBodyAndAttachments_MultipartNoBody(t *testing.T) {
 
 func TestParseSubjectBodyAndAttachments_EncodedSubject(t *testing.T) {
 	raw := "From: test@example.com\r\nTo: you@example.com\r\nSubject: =?UTF-8?B?SGVsbG8g8J+agA==?=\r\n\r\nBody"
-	subject, body, _, _, err := parseSubjectBodyAndAttachments(raw)
+	subject, body, _, _, err := parseSubjectBodyAndAttachments(context.Background(), raw)
 	if err != nil {
 		t.Fatalf("parseSubjectBodyAndAttachments failed: %v", err)
 	}
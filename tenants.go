@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tTenantConfig is a named Entra tenant profile; oauth2_config remains the default tenant
+type tTenantConfig struct {
+	Name          string   `yaml:"name"`
+	Domains       []string `yaml:"domains"` // usernames in these domains (and subdomains) use this tenant
+	Users         []string `yaml:"users"`   // explicit usernames mapped to this tenant, checked before domains
+	tOAuth2Config `yaml:",inline"`
+}
+
+// selectTenant returns the tenant profile for a username. The listener's tenant wins, then the users
+// lists, then the domains lists; otherwise oauth2_config is used under the name "".
+func selectTenant(c *tConfig, listenerTenant, username string) (string, tOAuth2Config, error) {
+	if listenerTenant != "" {
+		for _, t := range c.Tenants {
+			if t.Name == listenerTenant {
+				return t.Name, t.tOAuth2Config, nil
+			}
+		}
+		return "", tOAuth2Config{}, fmt.Errorf("unknown tenant %q", listenerTenant)
+	}
+	for _, t := range c.Tenants {
+		for _, u := range t.Users {
+			if strings.EqualFold(strings.TrimSpace(u), username) {
+				return t.Name, t.tOAuth2Config, nil
+			}
+		}
+	}
+	if domain := addressDomain(username); domain != "" {
+		for _, t := range c.Tenants {
+			if domainMatches(domain, t.Domains) {
+				return t.Name, t.tOAuth2Config, nil
+			}
+		}
+	}
+	return "", c.OAuth2Config, nil
+}
+
+// tokenCacheKey keys cached tokens by tenant and username so equal usernames in two tenants can't collide
+func tokenCacheKey(tenant, username string) string {
+	return tenant + "/" + strings.ToLower(username)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestSelectTenant(t *testing.T) {
+	var c tConfig
+	err := yaml.Unmarshal([]byte(`
+oauth2_config:
+    tenant_id: default.onmicrosoft.com
+tenants:
+    - name: a
+      domains: [a.com]
+      tenant_id: a.onmicrosoft.com
+    - name: b
+      domains: [b.com]
+      users: [scanner@a.com]
+      tenant_id: b.onmicrosoft.com
+`), &c)
+	if err != nil {
+		t.Fatalf("failed to parse tenants: %v", err)
+	}
+	tests := []struct {
+		listener, username, name, tenantID string
+	}{
+		{"", "app@a.com", "a", "a.onmicrosoft.com"},
+		{"", "app@sub.b.com", "b", "b.onmicrosoft.com"},
+		{"", "SCANNER@a.com", "b", "b.onmicrosoft.com"}, // user mapping before domain
+		{"a", "app@b.com", "a", "a.onmicrosoft.com"},    // listener before everything
+		{"", "app@other.com", "", "default.onmicrosoft.com"},
+	}
+	for _, tt := range tests {
+		name, oc, err := selectTenant(&c, tt.listener, tt.username)
+		if err != nil || name != tt.name || oc.TenantID != tt.tenantID {
+			t.Errorf("selectTenant(%q, %q) = %q %q %v, expected %q %q", tt.listener, tt.username, name, oc.TenantID, err, tt.name, tt.tenantID)
+		}
+	}
+	if _, _, err := selectTenant(&c, "missing", "app@a.com"); err == nil {
+		t.Errorf("expected error for unknown listener tenant")
+	}
+	if tokenCacheKey("a", "app@x.com") == tokenCacheKey("b", "app@x.com") {
+		t.Errorf("expected token cache keys to differ per tenant")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TokenCache holds cached OAuth2 tokens per tenant and user (thread-safe), see tokenCacheKey
+var TokenCache sync.Map
+
+const (
+	tokenExpirySkew      = 60 * time.Second // treat tokens as expired this long before they are
+	tokenRefreshAhead    = 5 * time.Minute  // background refresh of tokens in use this long before expiry
+	tokenRefreshInterval = 30 * time.Second
+	tokenIdleEviction    = 24 * time.Hour // keep expired tokens with a refresh token this long after last use
+)
+
+type cachedToken struct {
+	token     string
+	expiresAt time.Time
+	fetchedAt time.Time
+	lastUsed  atomic.Int64 // unix nanoseconds
+	cred      []byte       // credHash of the password the token was issued for
+	// for renewals without the password
+	refreshToken     string
+	tenant, username string
+	oauth2           tOAuth2Config
+}
+
+// credKey keys the password hashes kept in the cache; it only leaves the process inside the encrypted
+// token cache file (see loadTokenCache)
+var credKey = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// credHash lets a cached token be matched against the password of a later AUTH, so a cached
+// token never authenticates a wrong password
+func credHash(password string) []byte {
+	m := hmac.New(sha256.New, credKey)
+	m.Write([]byte(password))
+	return m.Sum(nil)
+}
+
+// tokenFetch is an in-flight token request shared by concurrent callers with the same key and password
+type tokenFetch struct {
+	done     chan struct{}
+	entry    *cachedToken
+	err      error
+	waiters  int       // callers still waiting, guarded by tokenFetches
+	deadline time.Time // latest deadline of the waiters, guarded by tokenFetches
+	timer    *time.Timer
+	cancel   context.CancelFunc
+}
+
+var tokenFetches = struct {
+	sync.Mutex
+	m map[string]*tokenFetch
+}{m: map[string]*tokenFetch{}}
+
+var errPasswordRequired = errors.New("the cached token can't be renewed without the password, authenticate again")
+
+// getCachedOAuth2Token returns a cached token, renews it with its refresh token when expired, or gets a
+// new one with the password; tenant is the listener's tenant profile or "" to select it by username
+func getCachedOAuth2Token(ctx context.Context, tenant, username, password string) (string, error) {
+	return getOAuth2TokenForCred(ctx, tenant, username, credHash(password), password)
+}
+
+// getOAuth2TokenForCred is getCachedOAuth2Token for the credHash cred of the password. password may be ""
+// while a renewable token is cached for cred, otherwise it fails with errPasswordRequired.
+func getOAuth2TokenForCred(ctx context.Context, tenant, username string, cred []byte, password string) (string, error) {
+	tenant, oc, err := selectTenant(getConfig(), tenant, username)
+	if err != nil {
+		return "", err
+	}
+	key := tokenCacheKey(tenant, username)
+	if val, ok := TokenCache.Load(key); ok {
+		tok := val.(*cachedToken)
+		if hmac.Equal(tok.cred, cred) {
+			if time.Now().Before(tok.expiresAt) {
+				tok.lastUsed.Store(time.Now().UnixNano())
+				logger.Debug("Using cached OAuth2 token", "tenant", tenant, "username", username, "expires_at", tok.expiresAt)
+				return tok.token, nil
+			}
+			if tok.refreshToken != "" {
+				renewed, err := renewToken(ctx, key, tok)
+				if err == nil {
+					return renewed.token, nil
+				}
+				if !isRefreshTokenRevoked(err) {
+					return "", err
+				}
+				logger.Info("Refresh token revoked, using the password", "tenant", tenant, "username", username, "error", err)
+				TokenCache.CompareAndDelete(key, tok)
+			}
+		}
+	}
+	if password == "" {
+		return "", errPasswordRequired
+	}
+	tok, err := fetchToken(ctx, key, cred, tenant, oc, username, func(ctx context.Context) (tokenResponse, error) {
+		return getOAuth2TokenWithExpiry(ctx, oc, username, password)
+	})
+	if err != nil {
+		return "", err
+	}
+	return tok.token, nil
+}
+
+// renewableWithoutPassword reports whether a token with a refresh token is cached for cred, so the
+// caller can drop the plaintext password and keep only cred
+func renewableWithoutPassword(tenant, username string, cred []byte) bool {
+	tenant, _, err := selectTenant(getConfig(), tenant, username)
+	if err != nil {
+		return false
+	}
+	val, ok := TokenCache.Load(tokenCacheKey(tenant, username))
+	if !ok {
+		return false
+	}
+	tok := val.(*cachedToken)
+	return tok.refreshToken != "" && hmac.Equal(tok.cred, cred)
+}
+
+// renewToken renews a cached token with its refresh token
+func renewToken(ctx context.Context, key string, tok *cachedToken) (*cachedToken, error) {
+	return fetchToken(ctx, key, tok.cred, tok.tenant, tok.oauth2, tok.username, func(ctx context.Context) (tokenResponse, error) {
+		r, err := refreshOAuth2Token(ctx, tok.oauth2, tok.refreshToken, tok.username)
+		if err == nil && r.RefreshToken == "" {
+			r.RefreshToken = tok.refreshToken // not rotated
+		}
+		return r, err
+	})
+}
+
+// fetchToken runs grant against the token endpoint and caches the result. Concurrent calls for the same
+// key and password share one request; the request outlives a caller that gives up, so the others still get it.
+// It runs until the latest deadline of its callers and is cancelled when the last one gives up or the service stops.
+func fetchToken(ctx context.Context, key string, cred []byte, tenant string, oc tOAuth2Config, username string, grant func(context.Context) (tokenResponse, error)) (*cachedToken, error) {
+	flight := key + "\x00" + string(cred)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(durationOrDefault(getConfig().Timeouts.Token, defaultTokenTimeout))
+	}
+	tokenFetches.Lock()
+	f, ok := tokenFetches.m[flight]
+	if !ok {
+		fctx, cancel := context.WithCancel(activeSessions.baseContext())
+		f = &tokenFetch{done: make(chan struct{}), deadline: deadline, cancel: cancel}
+		f.timer = time.AfterFunc(time.Until(deadline), cancel)
+		tokenFetches.m[flight] = f
+		go func() {
+			defer func() {
+				tokenFetches.Lock()
+				if tokenFetches.m[flight] == f {
+					delete(tokenFetches.m, flight)
+				}
+				tokenFetches.Unlock()
+				f.timer.Stop()
+				cancel()
+				close(f.done)
+			}()
+			r, err := grant(fctx)
+			if err != nil {
+				f.err = err
+				return
+			}
+			now := time.Now()
+			f.entry = &cachedToken{
+				token:        r.AccessToken,
+				expiresAt:    now.Add(time.Duration(r.ExpiresIn)*time.Second - tokenExpirySkew),
+				fetchedAt:    now,
+				cred:         cred,
+				refreshToken: r.RefreshToken,
+				tenant:       tenant,
+				username:     username,
+				oauth2:       oc,
+			}
+			f.entry.lastUsed.Store(now.UnixNano())
+			TokenCache.Store(key, f.entry)
+			logger.Debug("New OAuth2 token cached", "tenant", tenant, "username", username, "expires_in", r.ExpiresIn)
+		}()
+	} else {
+		if deadline.After(f.deadline) {
+			f.deadline = deadline
+			f.timer.Reset(time.Until(deadline))
+		}
+		logger.Debug("Waiting for OAuth2 token request in progress", "tenant", tenant, "username", username)
+	}
+	f.waiters++
+	tokenFetches.Unlock()
+	select {
+	case <-f.done:
+		if f.err != nil && ctx.Err() != nil {
+			return nil, ctx.Err() // the request was cut short by this caller's own deadline
+		}
+		return f.entry, f.err
+	case <-ctx.Done():
+		tokenFetches.Lock()
+		if f.waiters--; f.waiters == 0 {
+			// Nobody waits for the result anymore, a new caller starts a new request
+			if tokenFetches.m[flight] == f {
+				delete(tokenFetches.m, flight)
+			}
+			f.cancel()
+		}
+		tokenFetches.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// tokenRefresh renews tokens used since they were fetched shortly before they expire and evicts
+// expired ones, until stop is closed
+func tokenRefresh(stop <-chan struct{}) {
+	ticker := time.NewTicker(tokenRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			tokenRefreshOnce(time.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+func tokenRefreshOnce(now time.Time) {
+	TokenCache.Range(func(k, v any) bool {
+		key, tok := k.(string), v.(*cachedToken)
+		expired := !now.Before(tok.expiresAt)
+		switch {
+		case expired && (tok.refreshToken == "" || now.Sub(time.Unix(0, tok.lastUsed.Load())) > tokenIdleEviction):
+			TokenCache.CompareAndDelete(key, tok)
+			logger.Debug("Expired OAuth2 token evicted", "tenant", tok.tenant, "username", tok.username)
+		case !expired && tok.refreshToken != "" && tok.expiresAt.Sub(now) < tokenRefreshAhead && tok.lastUsed.Load() > tok.fetchedAt.UnixNano():
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), durationOrDefault(getConfig().Timeouts.Token, defaultTokenTimeout))
+				defer cancel()
+				if _, err := renewToken(ctx, key, tok); err != nil {
+					logger.Warn("Background OAuth2 token refresh failed", "tenant", tok.tenant, "username", tok.username, "error", err)
+					if isRefreshTokenRevoked(err) {
+						TokenCache.CompareAndDelete(key, tok)
+					}
+					return
+				}
+				logger.Debug("OAuth2 token refreshed in background", "tenant", tok.tenant, "username", tok.username)
+			}()
+		}
+		return true
+	})
+}
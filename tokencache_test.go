@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeTokenEndpoint accepts the password "good" and its refresh tokens unless revoked is set, and counts requests
+func fakeTokenEndpoint(t *testing.T, delay time.Duration) *atomic.Int32 {
+	t.Helper()
+	var requests atomic.Int32
+	revokedRefreshTokens.Store(false)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.Contains(r.FormValue("scope"), "offline_access") {
+			t.Errorf("expected offline_access scope, got %q", r.FormValue("scope"))
+		}
+		switch r.FormValue("grant_type") {
+		case "refresh_token":
+			if !strings.HasPrefix(r.FormValue("refresh_token"), "rt-") || revokedRefreshTokens.Load() {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error": "invalid_grant", "error_description": "AADSTS50173: The provided grant has expired due to it being revoked.", "error_codes": [50173]}`)
+				return
+			}
+		default:
+			if r.FormValue("password") != "good" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error": "invalid_grant", "error_description": "AADSTS50126: Invalid username or password.", "error_codes": [50126]}`)
+				return
+			}
+		}
+		fmt.Fprintf(w, `{"access_token": "token-%d", "refresh_token": "rt-%d", "expires_in": 3600}`, n, n)
+	}))
+	saved := tokenURLFormat
+	tokenURLFormat = srv.URL + "/%s/token"
+	setConfig(&tConfig{OAuth2Config: tOAuth2Config{TenantID: "contoso.onmicrosoft.com"}})
+	TokenCache.Clear()
+	t.Cleanup(func() {
+		srv.Close()
+		tokenURLFormat = saved
+		TokenCache.Clear()
+	})
+	return &requests
+}
+
+var revokedRefreshTokens atomic.Bool
+
+// expireCachedToken makes the cached token of username look expired
+func expireCachedToken(t *testing.T, username string) {
+	t.Helper()
+	v, ok := TokenCache.Load(tokenCacheKey("", username))
+	if !ok {
+		t.Fatalf("no cached token for %s", username)
+	}
+	tok := v.(*cachedToken)
+	expired := &cachedToken{token: tok.token, expiresAt: time.Now().Add(-time.Second), fetchedAt: tok.fetchedAt, cred: tok.cred,
+		refreshToken: tok.refreshToken, tenant: tok.tenant, username: tok.username, oauth2: tok.oauth2}
+	TokenCache.Store(tokenCacheKey("", username), expired)
+}
+
+// A cached token used to authenticate AUTH with any password for its username
+func TestTokenCache_CachedTokenRequiresSamePassword(t *testing.T) {
+	requests := fakeTokenEndpoint(t, 0)
+	if _, err := getCachedOAuth2Token(context.Background(), "", "app@domain.com", "good"); err != nil {
+		t.Fatalf("getCachedOAuth2Token failed: %v", err)
+	}
+	if _, err := getCachedOAuth2Token(context.Background(), "", "app@domain.com", "good"); err != nil || requests.Load() != 1 {
+		t.Errorf("expected cached token, got %d requests, %v", requests.Load(), err)
+	}
+	if _, err := getCachedOAuth2Token(context.Background(), "", "app@domain.com", "wrong"); err == nil {
+		t.Errorf("expected a wrong password to fail despite the cached token")
+	}
+}
+
+func TestTokenCache_ConcurrentFetchesCollapse(t *testing.T) {
+	requests := fakeTokenEndpoint(t, 100*time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := getCachedOAuth2Token(context.Background(), "", "app@domain.com", "good"); err != nil {
+				t.Errorf("getCachedOAuth2Token failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected 1 token request, got %d", n)
+	}
+}
+
+func TestTokenCache_RefreshAndEvict(t *testing.T) {
+	requests := fakeTokenEndpoint(t, 0)
+	getCachedOAuth2Token(context.Background(), "", "used@domain.com", "good")
+	getCachedOAuth2Token(context.Background(), "", "idle@domain.com", "good")
+	used, _ := TokenCache.Load(tokenCacheKey("", "used@domain.com"))
+	used.(*cachedToken).lastUsed.Add(1)
+
+	// Shortly before expiry only the token in use is refreshed
+	tokenRefreshOnce(used.(*cachedToken).expiresAt.Add(-time.Minute))
+	deadline := time.Now().Add(5 * time.Second)
+	for requests.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := requests.Load(); n != 3 {
+		t.Errorf("expected one background refresh, got %d requests", n)
+	}
+	if v, _ := TokenCache.Load(tokenCacheKey("", "used@domain.com")); v == used {
+		t.Errorf("expected refreshed token to replace the old one")
+	}
+
+	// Expired tokens with a refresh token are kept for a day after their last use
+	tokenRefreshOnce(time.Now().Add(2 * time.Hour))
+	if _, ok := TokenCache.Load(tokenCacheKey("", "idle@domain.com")); !ok {
+		t.Errorf("expected expired token with a refresh token to be kept")
+	}
+	tokenRefreshOnce(time.Now().Add(25 * time.Hour))
+	if _, ok := TokenCache.Load(tokenCacheKey("", "idle@domain.com")); ok {
+		t.Errorf("expected expired token to be evicted")
+	}
+}
+
+func TestTokenCache_RenewWithRefreshToken(t *testing.T) {
+	requests := fakeTokenEndpoint(t, 0)
+	if _, err := getCachedOAuth2Token(context.Background(), "", "app@domain.com", "good"); err != nil {
+		t.Fatalf("getCachedOAuth2Token failed: %v", err)
+	}
+	expireCachedToken(t, "app@domain.com")
+	token, err := getCachedOAuth2Token(context.Background(), "", "app@domain.com", "good")
+	if err != nil || token != "token-2" {
+		t.Fatalf("expected renewed token-2, got %q, %v", token, err)
+	}
+	expireCachedToken(t, "app@domain.com")
+	if _, err := getCachedOAuth2Token(context.Background(), "", "app@domain.com", "wrong"); err == nil {
+		t.Errorf("expected a wrong password to fail despite the refresh token")
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("expected 3 token requests, got %d", n)
+	}
+}
+
+func TestTokenCache_RevokedRefreshTokenFallsBackToPassword(t *testing.T) {
+	requests := fakeTokenEndpoint(t, 0)
+	if _, err := getCachedOAuth2Token(context.Background(), "", "app@domain.com", "good"); err != nil {
+		t.Fatalf("getCachedOAuth2Token failed: %v", err)
+	}
+	expireCachedToken(t, "app@domain.com")
+	revokedRefreshTokens.Store(true)
+	token, err := getCachedOAuth2Token(context.Background(), "", "app@domain.com", "good")
+	if err != nil || token != "token-3" {
+		t.Fatalf("expected token-3 from the password grant, got %q, %v", token, err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("expected refresh then password request, got %d requests", n)
+	}
+}
+
+// Sessions keep only the hash of the password once the token can be renewed without it
+func TestTokenCache_RenewWithoutPassword(t *testing.T) {
+	requests := fakeTokenEndpoint(t, 0)
+	cred := credHash("good")
+	if renewableWithoutPassword("", "app@domain.com", cred) {
+		t.Errorf("expected no renewable token before the first request")
+	}
+	if _, err := getOAuth2TokenForCred(context.Background(), "", "app@domain.com", cred, ""); !errors.Is(err, errPasswordRequired) {
+		t.Errorf("expected errPasswordRequired without a cached token, got %v", err)
+	}
+	if _, err := getCachedOAuth2Token(context.Background(), "", "app@domain.com", "good"); err != nil {
+		t.Fatalf("getCachedOAuth2Token failed: %v", err)
+	}
+	if !renewableWithoutPassword("", "app@domain.com", cred) || renewableWithoutPassword("", "app@domain.com", credHash("wrong")) {
+		t.Errorf("expected the cached token to be renewable for its own password only")
+	}
+	expireCachedToken(t, "app@domain.com")
+	if token, err := getOAuth2TokenForCred(context.Background(), "", "app@domain.com", cred, ""); err != nil || token != "token-2" {
+		t.Errorf("expected the refresh token to renew without the password, got %q, %v", token, err)
+	}
+	revokedRefreshTokens.Store(true)
+	expireCachedToken(t, "app@domain.com")
+	if _, err := getOAuth2TokenForCred(context.Background(), "", "app@domain.com", cred, ""); !errors.Is(err, errPasswordRequired) {
+		t.Errorf("expected errPasswordRequired once the refresh token is revoked, got %v", err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("expected 3 token requests, got %d", n)
+	}
+}
+
+func TestFetchToken_RunsUntilTheLastDeadline(t *testing.T) {
+	key := tokenCacheKey("", "flight@domain.com")
+	t.Cleanup(func() { TokenCache.Delete(key) })
+	var grants atomic.Int32
+	grant := func(ctx context.Context) (tokenResponse, error) {
+		grants.Add(1)
+		select {
+		case <-time.After(200 * time.Millisecond):
+			return tokenResponse{AccessToken: "token", ExpiresIn: 3600}, nil
+		case <-ctx.Done():
+			return tokenResponse{}, ctx.Err()
+		}
+	}
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	first := make(chan error, 1)
+	go func() {
+		_, err := fetchToken(short, key, nil, "", tOAuth2Config{}, "flight@domain.com", grant)
+		first <- err
+	}()
+	time.Sleep(10 * time.Millisecond) // join the flight of the first caller
+	long, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	tok, err := fetchToken(long, key, nil, "", tOAuth2Config{}, "flight@domain.com", grant)
+	if err != nil || tok.token != "token" {
+		t.Errorf("expected the request to run past the first caller's deadline, got %v", err)
+	}
+	if err := <-first; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the first caller to time out, got %v", err)
+	}
+	if n := grants.Load(); n != 1 {
+		t.Errorf("expected 1 token request, got %d", n)
+	}
+}
+
+func TestFetchToken_CancelledWhenNobodyWaits(t *testing.T) {
+	setConfig(&tConfig{})
+	key := tokenCacheKey("", "gone@domain.com")
+	cancelled := make(chan struct{})
+	grant := func(ctx context.Context) (tokenResponse, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return tokenResponse{}, ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel() // the client disconnects
+	}()
+	if _, err := fetchToken(ctx, key, nil, "", tOAuth2Config{}, "gone@domain.com", grant); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the caller to be cancelled, got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("expected the token request to be cancelled once its last caller is gone")
+	}
+}
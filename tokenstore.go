@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// With persist_tokens the TokenCache is saved to the spool directory, encrypted with the config secret key,
+// so clients don't need a new token after a restart
+const tokenCacheStateFile = "tokencache.enc"
+
+type persistedToken struct {
+	Key          string    `json:"key"`
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	LastUsed     time.Time `json:"last_used"`
+	Cred         []byte    `json:"cred"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Tenant       string    `json:"tenant"`
+	Username     string    `json:"username"`
+	ClientID     string    `json:"client_id"` // tokens of another app registration or tenant are dropped on load
+	TenantID     string    `json:"tenant_id"`
+}
+
+type persistedTokenCache struct {
+	CredKey []byte           `json:"cred_key"` // the stored cred hashes are only usable with their key
+	Tokens  []persistedToken `json:"tokens"`
+}
+
+var tokenStore struct {
+	sync.Mutex
+	lastSaved []byte // plaintext of the last save, unchanged caches are not rewritten
+}
+
+// keepToken reports whether a cached token is still worth keeping at now
+func keepToken(tok *cachedToken, now time.Time) bool {
+	if now.Before(tok.expiresAt) {
+		return true
+	}
+	return tok.refreshToken != "" && now.Sub(time.Unix(0, tok.lastUsed.Load())) <= tokenIdleEviction
+}
+
+// loadTokenCache fills the TokenCache from the spool directory. Call it before the first token is cached,
+// it replaces credKey.
+func loadTokenCache(spoolDir string) error {
+	data, err := os.ReadFile(filepath.Join(spoolDir, tokenCacheStateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	plain, err := openState(string(data))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", tokenCacheStateFile, err)
+	}
+	var pc persistedTokenCache
+	if err := json.Unmarshal(plain, &pc); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", tokenCacheStateFile, err)
+	}
+	if len(pc.CredKey) != len(credKey) {
+		return fmt.Errorf("invalid %s", tokenCacheStateFile)
+	}
+	credKey = pc.CredKey
+	c := getConfig()
+	now := time.Now()
+	loaded := 0
+	for _, p := range pc.Tokens {
+		_, oc, err := selectTenant(c, p.Tenant, "")
+		if err != nil || oc.ClientID != p.ClientID || oc.TenantID != p.TenantID {
+			continue
+		}
+		tok := &cachedToken{token: p.Token, expiresAt: p.ExpiresAt, fetchedAt: p.FetchedAt, cred: p.Cred,
+			refreshToken: p.RefreshToken, tenant: p.Tenant, username: p.Username, oauth2: oc}
+		tok.lastUsed.Store(p.LastUsed.UnixNano())
+		if !keepToken(tok, now) {
+			continue
+		}
+		TokenCache.Store(p.Key, tok)
+		loaded++
+	}
+	tokenStore.Lock()
+	tokenStore.lastSaved = plain
+	tokenStore.Unlock()
+	logger.Info("Token cache loaded", "tokens", loaded, "dropped", len(pc.Tokens)-loaded)
+	return nil
+}
+
+// saveTokenCache writes the TokenCache to the spool directory if it changed since the last save.
+// Expired tokens that can't be renewed are left out.
+func saveTokenCache(spoolDir string) error {
+	now := time.Now()
+	pc := persistedTokenCache{CredKey: credKey, Tokens: []persistedToken{}}
+	TokenCache.Range(func(k, v any) bool {
+		tok := v.(*cachedToken)
+		if keepToken(tok, now) {
+			pc.Tokens = append(pc.Tokens, persistedToken{Key: k.(string), Token: tok.token, ExpiresAt: tok.expiresAt,
+				FetchedAt: tok.fetchedAt, LastUsed: time.Unix(0, tok.lastUsed.Load()), Cred: tok.cred,
+				RefreshToken: tok.refreshToken, Tenant: tok.tenant, Username: tok.username,
+				ClientID: tok.oauth2.ClientID, TenantID: tok.oauth2.TenantID})
+		}
+		return true
+	})
+	plain, err := json.Marshal(pc)
+	if err != nil {
+		return err
+	}
+	tokenStore.Lock()
+	defer tokenStore.Unlock()
+	if bytes.Equal(plain, tokenStore.lastSaved) {
+		return nil
+	}
+	data, err := sealState(plain)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(spoolDir, tokenCacheStateFile)
+	if err := os.WriteFile(path+".tmp", []byte(data), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	tokenStore.lastSaved = plain
+	return nil
+}
+
+// tokenCachePersist saves the token cache periodically until stop is closed
+func tokenCachePersist(spoolDir string, stop <-chan struct{}) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if err := saveTokenCache(spoolDir); err != nil {
+			logger.Error("Failed to save token cache", "error", err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenCache_PersistAcrossRestart(t *testing.T) {
+	requests := fakeTokenEndpoint(t, 0)
+	dir := t.TempDir()
+	t.Setenv(envSecretKeyFile, filepath.Join(dir, "secret.key"))
+	stateBox.b = nil
+	t.Cleanup(func() { stateBox.b = nil })
+	tokenStore.lastSaved = nil
+
+	if _, err := getCachedOAuth2Token(context.Background(), "", "app@domain.com", "good"); err != nil {
+		t.Fatalf("getCachedOAuth2Token failed: %v", err)
+	}
+	getCachedOAuth2Token(context.Background(), "", "gone@domain.com", "good")
+	v, _ := TokenCache.Load(tokenCacheKey("", "gone@domain.com"))
+	v.(*cachedToken).refreshToken = "" // can't be renewed once expired
+	v.(*cachedToken).expiresAt = time.Now().Add(-time.Second)
+	if err := saveTokenCache(dir); err != nil {
+		t.Fatalf("saveTokenCache failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, tokenCacheStateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "rt-1") || strings.Contains(string(data), "token-1") {
+		t.Errorf("expected tokens to be encrypted at rest")
+	}
+
+	// Restart: a new process has a new credKey and an empty cache
+	TokenCache.Clear()
+	credKey = make([]byte, len(credKey))
+	if err := loadTokenCache(dir); err != nil {
+		t.Fatalf("loadTokenCache failed: %v", err)
+	}
+	if _, ok := TokenCache.Load(tokenCacheKey("", "gone@domain.com")); ok {
+		t.Errorf("expected expired token to be dropped")
+	}
+	if token, err := getCachedOAuth2Token(context.Background(), "", "app@domain.com", "good"); err != nil || token != "token-1" {
+		t.Errorf("expected persisted token-1, got %q, %v", token, err)
+	}
+	if _, err := getCachedOAuth2Token(context.Background(), "", "app@domain.com", "wrong"); err == nil {
+		t.Errorf("expected a wrong password to fail with a persisted token")
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("expected no token request for the persisted token, got %d requests", n)
+	}
+
+	// Tokens of another app registration are dropped
+	TokenCache.Clear()
+	setConfig(&tConfig{OAuth2Config: tOAuth2Config{TenantID: "contoso.onmicrosoft.com", ClientID: "other"}})
+	if err := loadTokenCache(dir); err != nil {
+		t.Fatalf("loadTokenCache failed: %v", err)
+	}
+	if _, ok := TokenCache.Load(tokenCacheKey("", "app@domain.com")); ok {
+		t.Errorf("expected token of another client_id to be dropped")
+	}
+}